@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"bytes"
+	"io/ioutil"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -17,11 +20,31 @@ import (
 )
 
 type ImageCmdOptions struct {
-	DefaultStageInImage string
-	BuildahPath         string
-	BuildahTimeout      time.Duration
-	BuildahGcTimeout    time.Duration
-	BuildahGcPeriod     time.Duration
+	DefaultStageInImage    string
+	StateDir               string
+	BuildahPath            string
+	BuildahTimeout         time.Duration
+	BuildahGcTimeout       time.Duration
+	BuildahGcPeriod        time.Duration
+	AsyncStageOut          bool
+	WatchPods              bool
+	StageOutWorkers        int
+	StageOutMaxRetries     int
+	RecordStages           bool
+	SpoolDir               string
+	SpoolRetryPeriod       time.Duration
+	SpoolMaxAttempts       int
+	NotifyURLs             []string
+	NotifySecretFile       string
+	NotifyURLAllowPrefixes []string
+	AuditLog               string
+	AuditLogMaxSizeMB      int64
+	AuditLogMaxBackups     int
+
+	MaxConcurrentStageIns             int
+	MaxConcurrentStageInsPerRegistry  map[string]int
+	MaxConcurrentStageOuts            int
+	MaxConcurrentStageOutsPerRegistry map[string]int
 }
 
 // imageCmd represents the Image command
@@ -42,25 +65,68 @@ var imageCmd = &cobra.Command{
 			zlog.Warn().Msg("failed to build kubernetes config.")
 		}
 		var kubeClient kubernetes.Interface
+		var dynamicClient dynamic.Interface
 		if config != nil {
 			kubeClient, err = kubernetes.NewForConfig(rest.AddUserAgent(config, "csi-driver-stager"))
 			if err != nil {
 				panic(err.Error())
 			}
+			dynamicClient, err = dynamic.NewForConfig(rest.AddUserAgent(config, "csi-driver-stager"))
+			if err != nil {
+				panic(err.Error())
+			}
 		}
 
 		if kubeClient == nil {
 			zlog.Warn().Msg("failed to create kubernetes client.")
 		}
 
-		driver := imagedriver.NewDriver(
-			Version, Options.NodeID, Options.Endpoint, Options.Image.DefaultStageInImage,
-			Options.Image.BuildahPath, Options.Image.BuildahTimeout,
-			Options.Image.BuildahGcTimeout, Options.Image.BuildahGcPeriod,
-			kubeClient, clock.RealClock{},
-		)
+		var notifySecret []byte
+		if Options.Image.NotifySecretFile != "" {
+			notifySecret, err = ioutil.ReadFile(Options.Image.NotifySecretFile)
+			if err != nil {
+				zlog.Error().Err(err).Str("NotifySecretFile", Options.Image.NotifySecretFile).Msg("failed to read notify secret file")
+				os.Exit(1)
+			}
+			notifySecret = bytes.TrimSpace(notifySecret)
+		}
+
+		driver, err := imagedriver.NewDriver(imagedriver.Config{
+			VendorVersion:          Version,
+			NodeID:                 Options.NodeID,
+			Endpoint:               Options.Endpoint,
+			DefaultStageInImage:    Options.Image.DefaultStageInImage,
+			StateDir:               Options.Image.StateDir,
+			BuildahPath:            Options.Image.BuildahPath,
+			BuildahTimeout:         Options.Image.BuildahTimeout,
+			BuildahGcTimeout:       Options.Image.BuildahGcTimeout,
+			BuildahGcPeriod:        Options.Image.BuildahGcPeriod,
+			AsyncStageOut:          Options.Image.AsyncStageOut,
+			WatchPods:              Options.Image.WatchPods,
+			StageOutWorkers:        Options.Image.StageOutWorkers,
+			StageOutMaxRetries:     Options.Image.StageOutMaxRetries,
+			RecordStages:           Options.Image.RecordStages,
+			SpoolDir:               Options.Image.SpoolDir,
+			SpoolRetryPeriod:       Options.Image.SpoolRetryPeriod,
+			SpoolMaxAttempts:       Options.Image.SpoolMaxAttempts,
+			NotifyURLs:             Options.Image.NotifyURLs,
+			NotifySecret:           notifySecret,
+			NotifyURLAllowPrefixes: Options.Image.NotifyURLAllowPrefixes,
+			AuditLogPath:           Options.Image.AuditLog,
+			AuditLogMaxSize:        Options.Image.AuditLogMaxSizeMB * 1024 * 1024,
+			AuditLogMaxBackups:     Options.Image.AuditLogMaxBackups,
+
+			MaxConcurrentStageIns:             Options.Image.MaxConcurrentStageIns,
+			MaxConcurrentStageInsPerRegistry:  Options.Image.MaxConcurrentStageInsPerRegistry,
+			MaxConcurrentStageOuts:            Options.Image.MaxConcurrentStageOuts,
+			MaxConcurrentStageOutsPerRegistry: Options.Image.MaxConcurrentStageOutsPerRegistry,
+		}, kubeClient, dynamicClient, clock.RealClock{})
+		if err != nil {
+			zlog.Error().Err(err).Msg("failed to initialize driver")
+			os.Exit(1)
+		}
 
-		signalCh := make(chan os.Signal)
+		signalCh := make(chan os.Signal, 1)
 		signal.Notify(signalCh, syscall.SIGINT)
 		signal.Notify(signalCh, syscall.SIGTERM)
 		go func() {
@@ -80,8 +146,27 @@ func init() {
 	rootCmd.AddCommand(imageCmd)
 
 	imageCmd.Flags().StringVar(&Options.Image.DefaultStageInImage, "defaultStageInImage", "busybox:latest", "default stage-in image")
+	imageCmd.Flags().StringVar(&Options.Image.StateDir, "stateDir", "/var/lib/csi-driver-stager/volumes", "directory to persist volume states. volumes are kept only in memory if empty")
 	imageCmd.Flags().StringVar(&Options.Image.BuildahPath, "buildahPath", "/bin/buildah", "buildah binary path")
 	imageCmd.Flags().DurationVar(&Options.Image.BuildahTimeout, "buildahTimeout", 10*time.Minute, "timeout to execute buildah commands")
 	imageCmd.Flags().DurationVar(&Options.Image.BuildahGcTimeout, "buildahGcTimeout", 60*time.Minute, "timeout to execute buildah gc command")
 	imageCmd.Flags().DurationVar(&Options.Image.BuildahGcPeriod, "buildahGcPeriod", 24*time.Hour, "period for performing buildah gc")
+	imageCmd.Flags().BoolVar(&Options.Image.AsyncStageOut, "asyncStageOut", false, "perform stage-out (commit and push) in background after unmounting volumes in NodeUnpublishVolume")
+	imageCmd.Flags().BoolVar(&Options.Image.WatchPods, "watchPods", true, "watch pods on the node to stage out volumes with stage-out/trigger=OnCompletion when their pods complete")
+	imageCmd.Flags().IntVar(&Options.Image.StageOutWorkers, "stageOutWorkers", 2, "number of background stage-out workers (used with --asyncStageOut or --watchPods)")
+	imageCmd.Flags().IntVar(&Options.Image.StageOutMaxRetries, "stageOutMaxRetries", 10, "max retries of background stage-out (used with --asyncStageOut or --watchPods)")
+	imageCmd.Flags().BoolVar(&Options.Image.RecordStages, "recordStages", false, "create a StageRecord custom resource per stage-in and stage-out. the StageRecord CRD must be installed")
+	imageCmd.Flags().StringVar(&Options.Image.SpoolDir, "spoolDir", "/var/lib/csi-driver-stager/spool", "directory to spool images which failed to be pushed with stage-out/failurePolicy=Spool. spooling is disabled if empty")
+	imageCmd.Flags().DurationVar(&Options.Image.SpoolRetryPeriod, "spoolRetryPeriod", 5*time.Minute, "period for retrying to push spooled images")
+	imageCmd.Flags().IntVar(&Options.Image.SpoolMaxAttempts, "spoolMaxAttempts", 288, "number of failed pushes after which spooled images are given up. their archives are kept in the spool directory. 0 means no limit")
+	imageCmd.Flags().StringSliceVar(&Options.Image.NotifyURLs, "notifyURL", []string{}, "URL to post CloudEvents of stage lifecycle of all volumes to. it can be specified multiple times")
+	imageCmd.Flags().StringVar(&Options.Image.NotifySecretFile, "notifySecretFile", "", "file containing the secret to sign notifications with HMAC-SHA256 (X-Stager-Signature-256 header)")
+	imageCmd.Flags().StringSliceVar(&Options.Image.NotifyURLAllowPrefixes, "notifyURLAllowPrefix", []string{}, "prefix which notify/url of volumes must start with (e.g. https://hooks.example.com/). its scheme and host must match exactly and its path must be a leading path of notify/url. it can be specified multiple times. notify/url is rejected if none is specified")
+	imageCmd.Flags().StringVar(&Options.Image.AuditLog, "auditLog", "", "file to write JSON lines audit log of stage-in, stage-out and checkpoints. audit log is disabled if empty")
+	imageCmd.Flags().Int64Var(&Options.Image.AuditLogMaxSizeMB, "auditLogMaxSizeMB", 100, "max size in megabytes of the audit log before it is rotated. 0 disables rotation")
+	imageCmd.Flags().IntVar(&Options.Image.AuditLogMaxBackups, "auditLogMaxBackups", 5, "max number of rotated audit log files to keep")
+	imageCmd.Flags().IntVar(&Options.Image.MaxConcurrentStageIns, "maxConcurrentStageIns", 0, "max number of concurrent stage-in (pull) on the node. 0 means unlimited")
+	imageCmd.Flags().StringToIntVar(&Options.Image.MaxConcurrentStageInsPerRegistry, "maxConcurrentStageInsPerRegistry", map[string]int{}, "max number of concurrent stage-in (pull) per registry on the node (e.g. docker.io=2,registry:5000=4)")
+	imageCmd.Flags().IntVar(&Options.Image.MaxConcurrentStageOuts, "maxConcurrentStageOuts", 0, "max number of concurrent stage-out (push) on the node. 0 means unlimited")
+	imageCmd.Flags().StringToIntVar(&Options.Image.MaxConcurrentStageOutsPerRegistry, "maxConcurrentStageOutsPerRegistry", map[string]int{}, "max number of concurrent stage-out (push) per registry on the node (e.g. docker.io=2,registry:5000=4)")
 }
@@ -0,0 +1,35 @@
+package image
+
+// The driver annotates pods with the results of staging their volumes.
+// Annotation keys are suffixed with the volume names in the pods (e.g. "stage-in.image.stager.csi.k8s.io/data").
+const (
+	StageInImageAnnotationPrefix   = "stage-in.image.stager.csi.k8s.io/"
+	StageInDigestAnnotationPrefix  = "stage-in-digest.image.stager.csi.k8s.io/"
+	StageOutImageAnnotationPrefix  = "stage-out.image.stager.csi.k8s.io/"
+	StageOutDigestAnnotationPrefix = "stage-out-digest.image.stager.csi.k8s.io/"
+	StageOutStatusAnnotationPrefix = "stage-out-status.image.stager.csi.k8s.io/"
+	// StageOutDestinationsAnnotationPrefix is the JSON array of the references pushed by stage-out and their outcomes.
+	// It is annotated only when stage-out pushes the image to more than one reference.
+	StageOutDestinationsAnnotationPrefix = "stage-out-destinations.image.stager.csi.k8s.io/"
+
+	// StageOutCompletedCondition is the pod condition which becomes True when stage-out of
+	// all the pod's volumes with stage-out/repository completed.
+	StageOutCompletedCondition = "StageOutCompleted"
+)
+
+// StageOutStatus is the value of stage-out-status annotations.
+type StageOutStatus string
+
+const (
+	StageOutStatusSucceeded StageOutStatus = "Succeeded"
+	StageOutStatusSkipped   StageOutStatus = "Skipped"
+	// StageOutStatusSpooled means the image is in the node's spool waiting to be pushed.
+	StageOutStatusSpooled StageOutStatus = "Spooled"
+	// StageOutStatusFailed means the last attempt failed. Stage-out may be retried.
+	StageOutStatusFailed StageOutStatus = "Failed"
+)
+
+// IsCompleted returns true when no more stage-out is performed on the node.
+func (s StageOutStatus) IsCompleted() bool {
+	return s == StageOutStatusSucceeded || s == StageOutStatusSkipped || s == StageOutStatusSpooled
+}
@@ -0,0 +1,18 @@
+package image
+
+// Labels set on staged-out images to record their provenance.
+// They take precedence over stage-out/labels.
+const (
+	ImageLabelPrefix = "image.stager.csi.k8s.io/"
+
+	PodNamespaceLabel      = ImageLabelPrefix + "pod-namespace"
+	PodNameLabel           = ImageLabelPrefix + "pod-name"
+	PodUIDLabel            = ImageLabelPrefix + "pod-uid"
+	PodServiceAccountLabel = ImageLabelPrefix + "pod-service-account"
+	NodeIDLabel            = ImageLabelPrefix + "node-id"
+	DriverVersionLabel     = ImageLabelPrefix + "driver-version"
+	StageInImageLabel      = ImageLabelPrefix + "stage-in-image"
+	StageInDigestLabel     = ImageLabelPrefix + "stage-in-digest"
+	// CommittedAtLabel is the commit time in RFC3339.
+	CommittedAtLabel = ImageLabelPrefix + "committed-at"
+)
@@ -0,0 +1,62 @@
+package image
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// NotifyURLKey is the endpoint which receives the volume's stage lifecycle notifications
+	// in addition to the driver's endpoints.
+	NotifyURLKey = "notify/url"
+)
+
+type NotifySpec struct {
+	URL string
+}
+
+func NewNotifySpec(context map[string]string) (NotifySpec, error) {
+	spec := NotifySpec{}
+	if urlStr, ok := context[NotifyURLKey]; ok {
+		u, err := url.Parse(urlStr)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return spec, errors.Errorf("%s must be http(s) url", NotifyURLKey)
+		}
+		spec.URL = urlStr
+	}
+	return spec, nil
+}
+
+// CheckAllowed returns an error unless URL is empty or matches one of the allowed prefixes.
+// A prefix matches when its scheme and host equal the URL's and its path is a leading path of the URL's.
+// The driver posts to the URL from the node, so volumes can't send notifications to arbitrary endpoints.
+func (spec NotifySpec) CheckAllowed(allowedPrefixes []string) error {
+	if spec.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(spec.URL)
+	if err != nil {
+		return errors.Wrapf(err, "can't parse %s=%s", NotifyURLKey, spec.URL)
+	}
+	for _, prefix := range allowedPrefixes {
+		if prefix == "" {
+			continue
+		}
+		p, err := url.Parse(prefix)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, p.Scheme) && strings.EqualFold(u.Host, p.Host) && hasPathPrefix(u.Path, p.Path) {
+			return nil
+		}
+	}
+	return errors.Errorf("%s=%s is not allowed by the driver", NotifyURLKey, spec.URL)
+}
+
+// hasPathPrefix reports whether prefix is path itself or one of its parent paths.
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
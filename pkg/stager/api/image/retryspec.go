@@ -0,0 +1,72 @@
+package image
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	StageInRetryMaxAttemptsKey    = "stage-in/retryMaxAttempts"
+	StageInRetryInitialBackoffKey = "stage-in/retryInitialBackoff"
+	StageInRetryMaxBackoffKey     = "stage-in/retryMaxBackoff"
+
+	StageOutRetryMaxAttemptsKey    = "stage-out/retryMaxAttempts"
+	StageOutRetryInitialBackoffKey = "stage-out/retryInitialBackoff"
+	StageOutRetryMaxBackoffKey     = "stage-out/retryMaxBackoff"
+
+	DefaultRetryMaxAttempts    = 3
+	DefaultRetryInitialBackoff = 2 * time.Second
+	DefaultRetryMaxBackoff     = 30 * time.Second
+)
+
+// RetrySpec configures retries of pulling or pushing images on transient errors (e.g. network errors).
+type RetrySpec struct {
+	// MaxAttempts includes the first attempt. 1 disables retries.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func newRetrySpec(context map[string]string, maxAttemptsKey, initialBackoffKey, maxBackoffKey string) (RetrySpec, error) {
+	spec := RetrySpec{
+		MaxAttempts:    DefaultRetryMaxAttempts,
+		InitialBackoff: DefaultRetryInitialBackoff,
+		MaxBackoff:     DefaultRetryMaxBackoff,
+	}
+
+	if maxAttemptsStr, ok := context[maxAttemptsKey]; ok {
+		maxAttempts, err := strconv.Atoi(maxAttemptsStr)
+		if err != nil || maxAttempts < 1 {
+			return spec, errors.Errorf("%s must be positive integer", maxAttemptsKey)
+		}
+		spec.MaxAttempts = maxAttempts
+	}
+
+	if initialBackoffStr, ok := context[initialBackoffKey]; ok {
+		initialBackoff, err := time.ParseDuration(initialBackoffStr)
+		if err != nil || initialBackoff < 0 {
+			return spec, errors.Errorf("%s must be non-negative duration", initialBackoffKey)
+		}
+		spec.InitialBackoff = initialBackoff
+	}
+
+	maxBackoffStr, maxBackoffSet := context[maxBackoffKey]
+	if maxBackoffSet {
+		maxBackoff, err := time.ParseDuration(maxBackoffStr)
+		if err != nil || maxBackoff < 0 {
+			return spec, errors.Errorf("%s must be non-negative duration", maxBackoffKey)
+		}
+		spec.MaxBackoff = maxBackoff
+	}
+
+	if spec.MaxBackoff < spec.InitialBackoff {
+		if maxBackoffSet {
+			return spec, errors.Errorf("%s must not be shorter than %s", maxBackoffKey, initialBackoffKey)
+		}
+		spec.MaxBackoff = spec.InitialBackoff
+	}
+
+	return spec, nil
+}
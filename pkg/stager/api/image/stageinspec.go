@@ -2,6 +2,7 @@ package image
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 	zlog "github.com/rs/zerolog/log"
@@ -10,11 +11,15 @@ import (
 const (
 	StageInImageKey     = "stage-in/image"
 	StageInTlsVerifyKey = "stage-in/tlsVerify"
+	StageInTimeoutKey   = "stage-in/timeout"
 )
 
 type StageInSpec struct {
 	TlsVerify bool
 	Image     string
+	Retry     RetrySpec
+	// Timeout overrides the driver's buildah timeout for pulling the image. Zero means the driver's default.
+	Timeout time.Duration
 }
 
 func NewStageInSpec(context map[string]string, defaultStageInImage string) (StageInSpec, error) {
@@ -37,5 +42,19 @@ func NewStageInSpec(context map[string]string, defaultStageInImage string) (Stag
 		spec.TlsVerify = tlsVerify
 	}
 
+	if timeoutStr, ok := context[StageInTimeoutKey]; ok {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil || timeout < 0 {
+			return spec, errors.Errorf("%s must be non-negative duration", StageInTimeoutKey)
+		}
+		spec.Timeout = timeout
+	}
+
+	retry, err := newRetrySpec(context, StageInRetryMaxAttemptsKey, StageInRetryInitialBackoffKey, StageInRetryMaxBackoffKey)
+	if err != nil {
+		return spec, err
+	}
+	spec.Retry = retry
+
 	return spec, nil
 }
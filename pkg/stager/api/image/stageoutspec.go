@@ -1,7 +1,11 @@
 package image
 
 import (
+	"encoding/json"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	zlog "github.com/rs/zerolog/log"
@@ -13,6 +17,82 @@ const (
 	StageOutTagGeneratorArgKey = "stage-out/tagGeneratorArg"
 	StageOutSquashKey          = "stage-out/squash"
 	StageOutTlsVerifyKey       = "stage-out/tlsVerify"
+	StageOutTimeoutKey         = "stage-out/timeout"
+	StageOutTriggerKey         = "stage-out/trigger"
+	StageOutWhenKey            = "stage-out/when"
+	// StageOutCheckpointIntervalKey enables pushing checkpoint images of running pods at the interval.
+	StageOutCheckpointIntervalKey = "stage-out/checkpointInterval"
+	// StageOutSkipIfUnchangedKey skips commit and push when nothing was written to the volume.
+	StageOutSkipIfUnchangedKey = "stage-out/skipIfUnchanged"
+	// StageOutFailurePolicyKey decides what to do when pushing the image failed after all retries.
+	StageOutFailurePolicyKey = "stage-out/failurePolicy"
+	// StageOutRepositoryOnFailureKey is the repository to push images of failed pods to instead of stage-out/repository.
+	StageOutRepositoryOnFailureKey = "stage-out/repositoryOnFailure"
+	// StageOutLabelsKey adds labels to staged-out images (e.g. "team=ml,run={{.podName}}").
+	// Values can be templates like stage-out/tagGeneratorArg with stage-out/tagGenerator=template.
+	StageOutLabelsKey = "stage-out/labels"
+	// StageOutConfig*Key override the config of staged-out images (see buildah config).
+	// Entrypoint and cmd are JSON arrays (exec form) or strings (shell form).
+	// Env is comma separated KEY=VALUE pairs.
+	StageOutConfigEntrypointKey = "stage-out/config.entrypoint"
+	StageOutConfigCmdKey        = "stage-out/config.cmd"
+	StageOutConfigEnvKey        = "stage-out/config.env"
+	StageOutConfigWorkingDirKey = "stage-out/config.workdir"
+	StageOutConfigAuthorKey     = "stage-out/config.author"
+	// StageOutFormatKey is the manifest format of staged-out images.
+	StageOutFormatKey = "stage-out/format"
+	// StageOutCompressionKey and StageOutCompressionLevelKey configure compression of pushed layers.
+	// Buildah's default (gzip) is used when they are not set.
+	StageOutCompressionKey      = "stage-out/compression"
+	StageOutCompressionLevelKey = "stage-out/compressionLevel"
+	// StageOutAdditionalTagsKey is comma separated tag generators with optional args (e.g. "fixed:latest,podName").
+	// The image is pushed with the additional tags as well as the tag by stage-out/tagGenerator.
+	StageOutAdditionalTagsKey = "stage-out/additionalTags"
+	// StageOutMirrorRepositoriesKey is comma separated repositories to push the image to in addition to
+	// stage-out/repository. Stage-out fails when pushing to them fails.
+	StageOutMirrorRepositoriesKey = "stage-out/mirrorRepositories"
+	// StageOutOptionalMirrorRepositoriesKey is like stage-out/mirrorRepositories, but failures to push to
+	// them don't fail stage-out. They are only reported in the destinations of the result.
+	StageOutOptionalMirrorRepositoriesKey = "stage-out/optionalMirrorRepositories"
+	// StageOutBaseKey is the base of staged-out images. With "scratch", only the files written to the volume
+	// are committed as a single layer on an empty image.
+	StageOutBaseKey = "stage-out/base"
+	// StageOutIncludeKey and StageOutExcludeKey are comma separated path patterns (see filepath.Match) relative
+	// to the volume root. They filter the files of stage-out/base=scratch images. A pattern matching a directory
+	// matches everything under it. Exclude wins over include.
+	StageOutIncludeKey = "stage-out/include"
+	StageOutExcludeKey = "stage-out/exclude"
+
+	// StageOutTriggerOnUnpublish stages out when the volume is unpublished (i.e. the pod is deleted).
+	StageOutTriggerOnUnpublish = "OnUnpublish"
+	// StageOutTriggerOnCompletion stages out as soon as all the pod's containers terminated.
+	// Unpublishing the volume then only cleans it up. Failed pushes are retried without committing again,
+	// and the image is spooled on the first failure with stage-out/failurePolicy=Spool.
+	StageOutTriggerOnCompletion = "OnCompletion"
+
+	// StageOutWhen* decide whether to stage out by the pod's outcome (i.e. its containers' exit codes).
+	StageOutWhenAlways    = "Always"
+	StageOutWhenOnSuccess = "OnSuccess"
+	StageOutWhenOnFailure = "OnFailure"
+	StageOutWhenNever     = "Never"
+
+	// StageOutFailurePolicyFail keeps unpublishing the volume failing until the image is pushed.
+	StageOutFailurePolicyFail = "Fail"
+	// StageOutFailurePolicySpool exports the image to an OCI archive in the node's spool directory and
+	// lets unpublishing complete. The driver keeps retrying to push spooled images in background.
+	StageOutFailurePolicySpool = "Spool"
+
+	StageOutFormatDocker = "docker"
+	StageOutFormatOCI    = "oci"
+
+	StageOutCompressionGzip = "gzip"
+	// StageOutCompressionZstd requires stage-out/format=oci.
+	StageOutCompressionZstd         = "zstd"
+	StageOutCompressionUncompressed = "uncompressed"
+
+	// StageOutBaseContainer commits the whole container including the stage-in image's layers.
+	StageOutBaseContainer = "container"
+	StageOutBaseScratch   = "scratch"
 )
 
 type StageOutSpec struct {
@@ -22,6 +102,47 @@ type StageOutSpec struct {
 	ImageRepository string
 	TagGenerator    string
 	TagGeneratorArg string
+	Retry           RetrySpec
+	// Timeout overrides the driver's buildah timeout for committing and pushing the image.
+	// Zero means the driver's default.
+	Timeout time.Duration
+	Trigger string
+	When    string
+	// RepositoryOnFailure is optional. ImageRepository is used for failed pods when it is empty.
+	RepositoryOnFailure string
+	// CheckpointInterval is zero when checkpoints are disabled.
+	CheckpointInterval time.Duration
+	SkipIfUnchanged    bool
+	FailurePolicy      string
+	// Labels are not rendered yet.
+	Labels map[string]string
+	Config ImageConfigSpec
+	Format string
+	// Compression is empty and CompressionLevel is zero when they are buildah's defaults.
+	Compression      string
+	CompressionLevel int
+	AdditionalTags   []TagGeneratorSpec
+	// MirrorRepositories and OptionalMirrorRepositories aren't used when the image is pushed to RepositoryOnFailure.
+	MirrorRepositories         []string
+	OptionalMirrorRepositories []string
+	Base                       string
+	// Include and Exclude are only used with StageOutBaseScratch. Empty Include includes everything.
+	Include []string
+	Exclude []string
+}
+
+type TagGeneratorSpec struct {
+	Name string
+	Arg  string
+}
+
+// ImageConfigSpec overrides the base image's config. Empty fields are kept as they are.
+type ImageConfigSpec struct {
+	Entrypoint string
+	Cmd        string
+	Env        map[string]string
+	WorkingDir string
+	Author     string
 }
 
 func NewStageOutSpec(context map[string]string) (StageOutSpec, error) {
@@ -31,6 +152,11 @@ func NewStageOutSpec(context map[string]string) (StageOutSpec, error) {
 	spec := StageOutSpec{}
 	spec.TlsVerify = true
 	spec.TagGenerator = "timestamp"
+	spec.Trigger = StageOutTriggerOnUnpublish
+	spec.When = StageOutWhenAlways
+	spec.FailurePolicy = StageOutFailurePolicyFail
+	spec.Format = StageOutFormatDocker
+	spec.Base = StageOutBaseContainer
 
 	// read values from context
 	imageRepository, ok := context[StageOutImageRepoKey]
@@ -65,5 +191,242 @@ func NewStageOutSpec(context map[string]string) (StageOutSpec, error) {
 		spec.TlsVerify = tlsVerify
 	}
 
+	if timeoutStr, ok := context[StageOutTimeoutKey]; ok {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil || timeout < 0 {
+			return spec, errors.Errorf("%s must be non-negative duration", StageOutTimeoutKey)
+		}
+		spec.Timeout = timeout
+	}
+
+	if trigger, ok := context[StageOutTriggerKey]; ok {
+		switch trigger {
+		case StageOutTriggerOnUnpublish, StageOutTriggerOnCompletion:
+			spec.Trigger = trigger
+		default:
+			return spec, errors.Errorf("%s must be one of %s, %s", StageOutTriggerKey, StageOutTriggerOnUnpublish, StageOutTriggerOnCompletion)
+		}
+	}
+
+	if when, ok := context[StageOutWhenKey]; ok {
+		switch when {
+		case StageOutWhenAlways, StageOutWhenOnSuccess, StageOutWhenOnFailure, StageOutWhenNever:
+			spec.When = when
+		default:
+			return spec, errors.Errorf("%s must be one of %s, %s, %s, %s", StageOutWhenKey, StageOutWhenAlways, StageOutWhenOnSuccess, StageOutWhenOnFailure, StageOutWhenNever)
+		}
+	}
+
+	if intervalStr, ok := context[StageOutCheckpointIntervalKey]; ok {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil || interval < 0 {
+			return spec, errors.Errorf("%s must be non-negative duration", StageOutCheckpointIntervalKey)
+		}
+		spec.CheckpointInterval = interval
+	}
+
+	if skipStr, ok := context[StageOutSkipIfUnchangedKey]; ok {
+		skip, err := strconv.ParseBool(skipStr)
+		if err != nil {
+			return spec, errors.Errorf("%s must be boolean", StageOutSkipIfUnchangedKey)
+		}
+		spec.SkipIfUnchanged = skip
+	}
+
+	if failurePolicy, ok := context[StageOutFailurePolicyKey]; ok {
+		switch failurePolicy {
+		case StageOutFailurePolicyFail, StageOutFailurePolicySpool:
+			spec.FailurePolicy = failurePolicy
+		default:
+			return spec, errors.Errorf("%s must be one of %s, %s", StageOutFailurePolicyKey, StageOutFailurePolicyFail, StageOutFailurePolicySpool)
+		}
+	}
+
+	if repositoryOnFailure, ok := context[StageOutRepositoryOnFailureKey]; ok {
+		spec.RepositoryOnFailure = repositoryOnFailure
+	}
+
+	if labelsStr, ok := context[StageOutLabelsKey]; ok {
+		labels, err := parseKeyValues(labelsStr)
+		if err != nil {
+			return spec, errors.Wrapf(err, "%s must be comma separated key=value pairs", StageOutLabelsKey)
+		}
+		spec.Labels = labels
+	}
+
+	if format, ok := context[StageOutFormatKey]; ok {
+		switch format {
+		case StageOutFormatDocker, StageOutFormatOCI:
+			spec.Format = format
+		default:
+			return spec, errors.Errorf("%s must be one of %s, %s", StageOutFormatKey, StageOutFormatDocker, StageOutFormatOCI)
+		}
+	}
+
+	if err := readCompression(context, &spec); err != nil {
+		return spec, err
+	}
+
+	if tagsStr, ok := context[StageOutAdditionalTagsKey]; ok {
+		for _, tag := range splitList(tagsStr) {
+			nameArg := strings.SplitN(tag, ":", 2)
+			tg := TagGeneratorSpec{Name: nameArg[0]}
+			if len(nameArg) == 2 {
+				tg.Arg = nameArg[1]
+			}
+			spec.AdditionalTags = append(spec.AdditionalTags, tg)
+		}
+	}
+	if mirrorsStr, ok := context[StageOutMirrorRepositoriesKey]; ok {
+		spec.MirrorRepositories = splitList(mirrorsStr)
+	}
+	if mirrorsStr, ok := context[StageOutOptionalMirrorRepositoriesKey]; ok {
+		spec.OptionalMirrorRepositories = splitList(mirrorsStr)
+	}
+
+	if err := readBase(context, &spec); err != nil {
+		return spec, err
+	}
+
+	config, err := newImageConfigSpec(context)
+	if err != nil {
+		return spec, err
+	}
+	spec.Config = config
+
+	retry, err := newRetrySpec(context, StageOutRetryMaxAttemptsKey, StageOutRetryInitialBackoffKey, StageOutRetryMaxBackoffKey)
+	if err != nil {
+		return spec, err
+	}
+	spec.Retry = retry
+
+	return spec, nil
+}
+
+func readCompression(context map[string]string, spec *StageOutSpec) error {
+	if compression, ok := context[StageOutCompressionKey]; ok {
+		switch compression {
+		case StageOutCompressionGzip, StageOutCompressionUncompressed:
+		case StageOutCompressionZstd:
+			if spec.Format != StageOutFormatOCI {
+				return errors.Errorf("%s=%s requires %s=%s", StageOutCompressionKey, StageOutCompressionZstd, StageOutFormatKey, StageOutFormatOCI)
+			}
+		default:
+			return errors.Errorf("%s must be one of %s, %s, %s", StageOutCompressionKey, StageOutCompressionGzip, StageOutCompressionZstd, StageOutCompressionUncompressed)
+		}
+		spec.Compression = compression
+	}
+
+	levelStr, ok := context[StageOutCompressionLevelKey]
+	if !ok {
+		return nil
+	}
+	level, err := strconv.Atoi(levelStr)
+	if err != nil {
+		return errors.Errorf("%s must be integer", StageOutCompressionLevelKey)
+	}
+	switch spec.Compression {
+	case StageOutCompressionUncompressed:
+		return errors.Errorf("%s can't be set with %s=%s", StageOutCompressionLevelKey, StageOutCompressionKey, StageOutCompressionUncompressed)
+	case StageOutCompressionZstd:
+		if level < 1 || level > 22 {
+			return errors.Errorf("%s must be in [1, 22] for %s", StageOutCompressionLevelKey, StageOutCompressionZstd)
+		}
+	default:
+		if level < 1 || level > 9 {
+			return errors.Errorf("%s must be in [1, 9] for %s", StageOutCompressionLevelKey, StageOutCompressionGzip)
+		}
+	}
+	spec.CompressionLevel = level
+	return nil
+}
+
+func newImageConfigSpec(context map[string]string) (ImageConfigSpec, error) {
+	spec := ImageConfigSpec{
+		Entrypoint: context[StageOutConfigEntrypointKey],
+		Cmd:        context[StageOutConfigCmdKey],
+		WorkingDir: context[StageOutConfigWorkingDirKey],
+		Author:     context[StageOutConfigAuthorKey],
+	}
+	for key, command := range map[string]string{StageOutConfigEntrypointKey: spec.Entrypoint, StageOutConfigCmdKey: spec.Cmd} {
+		if strings.HasPrefix(strings.TrimSpace(command), "[") {
+			var execForm []string
+			if err := json.Unmarshal([]byte(command), &execForm); err != nil {
+				return spec, errors.Errorf("%s must be JSON array of strings or string", key)
+			}
+		}
+	}
+	if envStr, ok := context[StageOutConfigEnvKey]; ok {
+		env, err := parseKeyValues(envStr)
+		if err != nil {
+			return spec, errors.Wrapf(err, "%s must be comma separated KEY=VALUE pairs", StageOutConfigEnvKey)
+		}
+		spec.Env = env
+	}
 	return spec, nil
 }
+
+func parseKeyValues(str string) (map[string]string, error) {
+	kvs := map[string]string{}
+	for _, pair := range strings.Split(str, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, errors.Errorf("invalid pair '%s'", pair)
+		}
+		kvs[key] = strings.TrimSpace(kv[1])
+	}
+	return kvs, nil
+}
+
+func readBase(context map[string]string, spec *StageOutSpec) error {
+	if base, ok := context[StageOutBaseKey]; ok {
+		switch base {
+		case StageOutBaseContainer, StageOutBaseScratch:
+			spec.Base = base
+		default:
+			return errors.Errorf("%s must be one of %s, %s", StageOutBaseKey, StageOutBaseContainer, StageOutBaseScratch)
+		}
+	}
+	var err error
+	if spec.Include, err = readPatterns(context, StageOutIncludeKey, spec.Base); err != nil {
+		return err
+	}
+	if spec.Exclude, err = readPatterns(context, StageOutExcludeKey, spec.Base); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readPatterns returns patterns relative to the volume root (e.g. "/outputs/" is "outputs").
+func readPatterns(context map[string]string, key, base string) ([]string, error) {
+	str, ok := context[key]
+	if !ok {
+		return nil, nil
+	}
+	if base != StageOutBaseScratch {
+		return nil, errors.Errorf("%s requires %s=%s", key, StageOutBaseKey, StageOutBaseScratch)
+	}
+	patterns := []string{}
+	for _, pattern := range splitList(str) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "%s has invalid pattern(=%s)", key, pattern)
+		}
+		patterns = append(patterns, strings.TrimPrefix(filepath.Clean("/"+pattern), "/"))
+	}
+	return patterns, nil
+}
+
+// splitList splits comma separated values. Empty values are dropped.
+func splitList(str string) []string {
+	values := []string{}
+	for _, value := range strings.Split(str, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
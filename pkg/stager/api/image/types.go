@@ -7,6 +7,7 @@ import (
 type StagerSpec struct {
 	StageInSpec  StageInSpec
 	StageOutSpec StageOutSpec
+	NotifySpec   NotifySpec
 }
 
 func NewSpec(context map[string]string, defaultStageInImage string) (*StagerSpec, error) {
@@ -22,8 +23,14 @@ func NewSpec(context map[string]string, defaultStageInImage string) (*StagerSpec
 		return nil, err
 	}
 
+	notifySpec, err := NewNotifySpec(context)
+	if err != nil {
+		return nil, err
+	}
+
 	return &StagerSpec{
 		StageInSpec:  stageInSpec,
 		StageOutSpec: stageOutSpec,
+		NotifySpec:   notifySpec,
 	}, err
 }
@@ -0,0 +1,70 @@
+// Package v1alpha1 contains the custom resources of the driver.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	GroupName = "stager.everpeace.github.com"
+	Version   = "v1alpha1"
+
+	StageRecordKind = "StageRecord"
+
+	// StageRecordPodUIDLabel and StageRecordStageLabel help to select records (e.g. kubectl get stagerecords -l ...).
+	StageRecordPodUIDLabel = GroupName + "/pod-uid"
+	StageRecordStageLabel  = GroupName + "/stage"
+)
+
+var (
+	SchemeGroupVersion   = schema.GroupVersion{Group: GroupName, Version: Version}
+	StageRecordsResource = SchemeGroupVersion.WithResource("stagerecords")
+)
+
+// StageRecord is the immutable record of a stage-in or a stage-out of a volume.
+// It is created in the namespace of the pod and outlives the pod.
+type StageRecord struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec StageRecordSpec `json:"spec"`
+}
+
+type StageRecordSpec struct {
+	// Stage is StageIn or StageOut.
+	Stage      string       `json:"stage"`
+	Pod        PodReference `json:"pod"`
+	NodeName   string       `json:"nodeName"`
+	VolumeID   string       `json:"volumeID"`
+	VolumeName string       `json:"volumeName"`
+	// Image is the pulled image for StageIn and the pushed image for StageOut.
+	Image  string `json:"image,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	// Result is Succeeded or Failed for StageIn, and the stage-out status for StageOut.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	// Phases are the volume's phase transitions in the stage.
+	Phases []PhaseTiming `json:"phases,omitempty"`
+	// Destinations are the references pushed by StageOut when there are more than one.
+	Destinations []Destination `json:"destinations,omitempty"`
+}
+
+type PodReference struct {
+	Name string    `json:"name"`
+	UID  types.UID `json:"uid"`
+}
+
+type Destination struct {
+	Image    string `json:"image"`
+	Required bool   `json:"required"`
+	Pushed   bool   `json:"pushed"`
+	Digest   string `json:"digest,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type PhaseTiming struct {
+	Phase string      `json:"phase"`
+	Time  metav1.Time `json:"time"`
+}
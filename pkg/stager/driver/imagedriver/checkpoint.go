@@ -0,0 +1,78 @@
+package imagedriver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// checkpointScanPeriod is the resolution of stage-out/checkpointInterval.
+const checkpointScanPeriod = 10 * time.Second
+
+// checkpointVolumes pushes checkpoint images of volumes whose checkpoint interval passed.
+// It returns after all the checkpoints finished.
+func (d *Driver) checkpointVolumes() {
+	volumes, err := d.volumes.List()
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to list volumes")
+		return
+	}
+	// volumes are shared without their locks. checkpointVolume checks whether checkpoints are enabled under the lock.
+	var wg sync.WaitGroup
+	for _, vol := range volumes {
+		wg.Add(1)
+		go func(volumeID string) {
+			defer wg.Done()
+			d.checkpointVolume(volumeID)
+		}(vol.VolumeID)
+	}
+	wg.Wait()
+}
+
+func isCheckpointEnabled(vol *image.Volume) bool {
+	return vol.Phase == image.PhasePublished &&
+		vol.Spec.StageOutSpec.Enabled &&
+		vol.Spec.StageOutSpec.CheckpointInterval > 0 &&
+		!vol.StagedOut
+}
+
+func (d *Driver) checkpointVolume(volumeID string) {
+	// busy volumes are checkpointed in the next scan.
+	if !d.volumeLocks.TryAcquire(volumeID) {
+		return
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	vol, err := d.getVolume(volumeID)
+	if err != nil {
+		zlog.Error().Err(err).Str("VolumeID", volumeID).Msg("failed to get volume")
+		return
+	}
+	if vol == nil || !isCheckpointEnabled(vol) {
+		return
+	}
+	logger := d.LogWithVolume(zlog.With().Str("Operation", "Checkpoint").Logger(), vol)
+
+	// the first checkpoint is taken after the interval since the volume is found.
+	if vol.LastCheckpointTime.IsZero() {
+		vol.LastCheckpointTime = d.clock.Now()
+		if err := d.volumes.Save(vol); err != nil {
+			logger.Error().Err(err).Msg("failed to save volume")
+		}
+		return
+	}
+	if d.clock.Since(vol.LastCheckpointTime) < vol.Spec.StageOutSpec.CheckpointInterval {
+		return
+	}
+
+	logger.Debug().Msg("start")
+	d.ensureDockerConfigJson(vol, logger)
+	if err := d.stager.Checkpoint(context.Background(), vol); err != nil {
+		logger.Error().Err(err).Msg("failed to checkpoint")
+		return
+	}
+	logger.Debug().Int("Checkpoints", vol.Checkpoints).Msg("succeeded")
+}
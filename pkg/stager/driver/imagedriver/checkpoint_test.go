@@ -0,0 +1,73 @@
+package imagedriver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	clock "k8s.io/utils/clock/testing"
+)
+
+var _ = Describe("Checkpoint", func() {
+	var workDir string
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should push checkpoint images periodically and stage out on unpublish", func() {
+		driver, backend := newTestDriverIn(workDir, kubefake.NewSimpleClientset())
+		recorder := record.NewFakeRecorder(100)
+		driver.stager.Recorder = recorder
+		checkpointClock := clock.NewFakeClock(fakeNow)
+		driver.clock = checkpointClock
+
+		req := newTestRequest(workDir, nil, map[string]string{api.StageOutCheckpointIntervalKey: "1m"})
+		volumeID := req.VolumeId
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("starting the interval on the first scan")
+		driver.checkpointVolumes()
+		Expect(backend.Pushed()).Should(BeEmpty())
+
+		By("not checkpointing before the interval passed")
+		checkpointClock.Step(30 * time.Second)
+		driver.checkpointVolumes()
+		Expect(backend.Pushed()).Should(BeEmpty())
+
+		By("checkpointing after the interval passed")
+		checkpointClock.Step(30 * time.Second)
+		driver.checkpointVolumes()
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name-checkpoint-1"}))
+		Expect(backend.Images()).Should(BeEmpty())
+		Expect(backend.Container(volumeID)).NotTo(BeNil())
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("CheckpointSucceeded")))
+
+		checkpointClock.Step(time.Minute)
+		driver.checkpointVolumes()
+		Expect(backend.Pushed()).Should(Equal([]string{
+			"registry:5000/test/test:test-name-checkpoint-1",
+			"registry:5000/test/test:test-name-checkpoint-2",
+		}))
+
+		By("staging out on unpublish")
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: req.TargetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Pushed()).Should(ContainElement("registry:5000/test/test:test-name"))
+		Expect(backend.Container(volumeID)).To(BeNil())
+	})
+})
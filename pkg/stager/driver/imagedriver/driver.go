@@ -2,7 +2,9 @@ package imagedriver
 
 import (
 	"context"
+	"fmt"
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/record"
 	"net"
 	"os"
@@ -13,19 +15,82 @@ import (
 	clientgokubescheme "k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/utils/clock"
+	"k8s.io/utils/mount"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	zlog "github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
 	DriverName = "image.stager.csi.k8s.io"
+
+	stageOutRetryBaseDelay = 5 * time.Second
+	stageOutRetryMaxDelay  = 5 * time.Minute
 )
 
+// Config is the configuration of Driver.
+type Config struct {
+	VendorVersion       string
+	NodeID              string
+	Endpoint            string
+	DefaultStageInImage string
+	// StateDir is the directory to persist volumes.
+	// Volumes are kept only in memory when it is empty.
+	StateDir string
+
+	BuildahPath      string
+	BuildahTimeout   time.Duration
+	BuildahGcTimeout time.Duration
+	BuildahGcPeriod  time.Duration
+
+	// AsyncStageOut makes NodeUnpublishVolume return right after unmounting targetPath.
+	// Then, stage-out is performed by StageOutWorkers background workers.
+	AsyncStageOut bool
+	// WatchPods enables stage-out of volumes with stage-out/trigger=OnCompletion when their pods complete.
+	// It requires kubernetes client.
+	WatchPods bool
+	// StageOutWorkers and StageOutMaxRetries configure both background stage-out
+	// (AsyncStageOut) and stage-out on completion (WatchPods).
+	StageOutWorkers    int
+	StageOutMaxRetries int
+
+	// RecordStages creates a StageRecord per stage-in and stage-out. It requires the StageRecord CRD.
+	RecordStages bool
+
+	// SpoolDir keeps images which failed to be pushed with stage-out/failurePolicy=Spool.
+	// Spooling is disabled when it is empty. Spooled images are retried every SpoolRetryPeriod
+	// and given up after SpoolMaxAttempts failed pushes.
+	SpoolDir         string
+	SpoolRetryPeriod time.Duration
+	SpoolMaxAttempts int
+
+	// NotifyURLs receive CloudEvents of stage lifecycle of all volumes in addition to their notify/url.
+	// Notifications are signed with NotifySecret when it is not empty.
+	NotifyURLs   []string
+	NotifySecret []byte
+	// NotifyURLAllowPrefixes are the prefixes which volumes' notify/url must start with.
+	// notify/url is rejected when it is empty.
+	NotifyURLAllowPrefixes []string
+
+	// AuditLogPath is the JSON lines audit log of stage operations. It is disabled when empty.
+	// The log is rotated when it exceeds AuditLogMaxSize bytes, keeping AuditLogMaxBackups files.
+	AuditLogPath       string
+	AuditLogMaxSize    int64
+	AuditLogMaxBackups int
+
+	// MaxConcurrentStageIns and MaxConcurrentStageOuts limit concurrent pulls and pushes on the node.
+	// The per-registry limits are keyed by registry hosts (e.g. "docker.io"). Zero means unlimited.
+	MaxConcurrentStageIns             int
+	MaxConcurrentStageInsPerRegistry  map[string]int
+	MaxConcurrentStageOuts            int
+	MaxConcurrentStageOutsPerRegistry map[string]int
+}
+
 type Driver struct {
 	clock        clock.Clock
 	vendorVesion string
@@ -34,23 +99,36 @@ type Driver struct {
 
 	srv        *grpc.Server
 	kubeClient kubernetes.Interface
-	recorder   record.EventRecorder
+	// dynamicClient creates StageRecords. It is nil unless stages are recorded.
+	dynamicClient dynamic.Interface
+	recorder      record.EventRecorder
+	mounter       mount.Interface
 
 	stager *image.Stager
 
 	defaultStageInImage string
-	statuses            map[string]*image.Volume
+	volumes             image.VolumeStore
+	volumeLocks         *volumeLocks
+
+	// stageOutQueue is nil unless stage-out is asynchronous.
+	stageOutQueue *stageOutQueue
+	// completionQueue stages out volumes whose pods completed. It is nil unless pods are watched.
+	completionQueue *stageOutQueue
+	stageOutWorkers int
+
+	spoolRetryPeriod time.Duration
+
+	// notifyURLAllowPrefixes are the prefixes which volumes' notify/url must start with.
+	notifyURLAllowPrefixes []string
+
+	stop chan struct{}
 }
 
-func NewDriver(
-	vendorVesion, nodeID, endpoint, defaultStageInImage string,
-	buildahPath string, buildahTimeout, buildahGcTimeout, buildahGcPeriod time.Duration,
-	kubeClient kubernetes.Interface,
-	clock clock.Clock) *Driver {
+func NewDriver(config Config, kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, clock clock.Clock) (*Driver, error) {
 	zlog.Debug().
 		Str("Driver", DriverName).
-		Str("VendorVersion", vendorVesion).
-		Str("NodeID", nodeID).
+		Str("VendorVersion", config.VendorVersion).
+		Str("NodeID", config.NodeID).
 		Msg("initialing driver")
 
 	var recorder record.EventRecorder
@@ -63,26 +141,114 @@ func NewDriver(
 		zlog.Warn().Msg("the driver won't publish any kubernetes events because it is initialized without kubernetes client")
 	}
 
-	return &Driver{
-		clock:               clock,
-		vendorVesion:        vendorVesion,
-		endpoint:            endpoint,
-		nodeID:              nodeID,
-		kubeClient:          kubeClient,
-		recorder:            recorder,
-		defaultStageInImage: defaultStageInImage,
-		statuses:            map[string]*image.Volume{},
+	mounter := mount.New("")
+
+	var volumes image.VolumeStore = image.NewMemoryVolumeStore()
+	if config.StateDir != "" {
+		fileStore, err := image.NewFileVolumeStore(config.StateDir, clock)
+		if err != nil {
+			return nil, err
+		}
+		volumes = fileStore
+	} else {
+		zlog.Warn().Msg("volumes are kept only in memory because state directory is not set")
+	}
+
+	var spool *image.Spool
+	if config.SpoolDir != "" {
+		var err error
+		if spool, err = image.NewSpool(config.SpoolDir); err != nil {
+			return nil, err
+		}
+		spool.MaxAttempts = config.SpoolMaxAttempts
+	} else {
+		zlog.Warn().Msg("stage-out/failurePolicy=Spool falls back to Fail because spool directory is not set")
+	}
+
+	var auditLog *image.AuditLog
+	if config.AuditLogPath != "" {
+		var err error
+		if auditLog, err = image.NewAuditLog(config.AuditLogPath, config.AuditLogMaxSize, config.AuditLogMaxBackups); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &Driver{
+		clock:                  clock,
+		vendorVesion:           config.VendorVersion,
+		endpoint:               config.Endpoint,
+		nodeID:                 config.NodeID,
+		kubeClient:             kubeClient,
+		recorder:               recorder,
+		mounter:                mounter,
+		defaultStageInImage:    config.DefaultStageInImage,
+		volumes:                volumes,
+		volumeLocks:            newVolumeLocks(),
+		stageOutWorkers:        config.StageOutWorkers,
+		spoolRetryPeriod:       config.SpoolRetryPeriod,
+		notifyURLAllowPrefixes: config.NotifyURLAllowPrefixes,
+		stop:                   make(chan struct{}),
 		stager: &image.Stager{
 			Buildah: &buildah.Client{
 				DriverName: DriverName,
-				ExecPath:   buildahPath,
-				Timeout:    buildahTimeout,
-				GcTimeout:  buildahGcTimeout,
+				ExecPath:   config.BuildahPath,
+				Timeout:    config.BuildahTimeout,
+				GcTimeout:  config.BuildahGcTimeout,
 			},
-			GcPeriod: buildahGcPeriod,
+			GcPeriod: config.BuildahGcPeriod,
 			Recorder: recorder,
+			Mounter:  mounter,
+			Store:    volumes,
+			StageInLimiter: image.NewConcurrencyLimiter(
+				config.MaxConcurrentStageIns, config.MaxConcurrentStageInsPerRegistry,
+			),
+			StageOutLimiter: image.NewConcurrencyLimiter(
+				config.MaxConcurrentStageOuts, config.MaxConcurrentStageOutsPerRegistry,
+			),
+			Spool: spool,
+			Notifier: &image.Notifier{
+				URLs:   config.NotifyURLs,
+				Secret: config.NotifySecret,
+				Source: fmt.Sprintf("%s/nodes/%s", DriverName, config.NodeID),
+			},
+			AuditLog:      auditLog,
+			NodeID:        config.NodeID,
+			DriverVersion: config.VendorVersion,
 		},
 	}
+
+	d.stager.OutcomeResolver = d
+	d.stager.Reporter = d
+	d.stager.History = d
+	d.stager.SecretResolver = d
+
+	if config.RecordStages {
+		if dynamicClient != nil {
+			d.dynamicClient = dynamicClient
+		} else {
+			zlog.Warn().Msg("the driver won't record stages because it is initialized without kubernetes client")
+		}
+	}
+
+	if config.AsyncStageOut {
+		d.stageOutQueue = newStageOutQueue(
+			config.StageOutMaxRetries, stageOutRetryBaseDelay, stageOutRetryMaxDelay,
+			d.processStageOut, d.abandonStageOut,
+		)
+	}
+
+	if config.WatchPods {
+		if kubeClient != nil {
+			d.completionQueue = newStageOutQueue(
+				config.StageOutMaxRetries, stageOutRetryBaseDelay, stageOutRetryMaxDelay,
+				d.processCompletedVolume, d.abandonCompletedVolume,
+			)
+		} else {
+			zlog.Warn().Msg("the driver won't watch pods because it is initialized without kubernetes client")
+		}
+	}
+
+	return d, nil
 }
 
 func (d *Driver) Run() error {
@@ -92,8 +258,27 @@ func (d *Driver) Run() error {
 		Str("NodeID", d.nodeID).
 		Msg("starting driver")
 
-	stop := make(chan struct{})
-	go func() { d.stager.StartGarbageCollection(stop) }()
+	if err := d.reconcileVolumes(); err != nil {
+		zlog.Error().Err(err).Msg("failed to reconcile volumes")
+	}
+
+	go func() { d.stager.StartGarbageCollection(d.stop) }()
+	go wait.Until(d.checkpointVolumes, checkpointScanPeriod, d.stop)
+	if d.stager.Spool != nil && d.spoolRetryPeriod > 0 {
+		go d.pushSpooledImages()
+	}
+
+	if d.stageOutQueue != nil {
+		if err := d.enqueueUnpublishingVolumes(); err != nil {
+			zlog.Error().Err(err).Msg("failed to enqueue volumes being unpublished")
+		}
+		go d.stageOutQueue.Run(d.stageOutWorkers)
+	}
+
+	if d.completionQueue != nil {
+		go d.completionQueue.Run(d.stageOutWorkers)
+		d.startPodInformer(d.stop)
+	}
 
 	scheme, addr, err := csicommon.ParseEndpoint(d.endpoint)
 	if err != nil {
@@ -128,6 +313,17 @@ func (d *Driver) Run() error {
 	return d.srv.Serve(listener)
 }
 
+// pushSpooledImages retries pushing spooled images until the driver stops.
+func (d *Driver) pushSpooledImages() {
+	// pushes are killed when stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-d.stop
+		cancel()
+	}()
+	wait.Until(func() { d.stager.PushSpooledImages(ctx) }, d.spoolRetryPeriod, d.stop)
+}
+
 func (d *Driver) Shutdown() {
 	zlog.Info().
 		Str("Driver", DriverName).
@@ -135,4 +331,15 @@ func (d *Driver) Shutdown() {
 		Str("NodeID", d.nodeID).
 		Msg("shutting down driver gracefully")
 	d.srv.GracefulStop()
+	close(d.stop)
+	if d.stageOutQueue != nil {
+		d.stageOutQueue.ShutDown()
+	}
+	if d.completionQueue != nil {
+		d.completionQueue.ShutDown()
+	}
+	d.stager.Notifier.Wait()
+	if err := d.stager.AuditLog.Close(); err != nil {
+		zlog.Error().Err(err).Msg("failed to close audit log")
+	}
 }
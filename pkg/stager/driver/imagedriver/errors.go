@@ -0,0 +1,32 @@
+package imagedriver
+
+import (
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stagerStatusError converts errors of the stager to gRPC status errors so that
+// kubelet (and alerting on it) can tell causes of failures apart.
+func stagerStatusError(err error) error {
+	return status.Error(stagerStatusCode(err), err.Error())
+}
+
+func stagerStatusCode(err error) codes.Code {
+	switch buildah.ClassOf(err) {
+	case buildah.ErrorClassAuth:
+		return codes.PermissionDenied
+	case buildah.ErrorClassNotFound:
+		return codes.NotFound
+	case buildah.ErrorClassTimeout:
+		return codes.DeadlineExceeded
+	case buildah.ErrorClassCanceled:
+		return codes.Canceled
+	case buildah.ErrorClassStorageExhausted:
+		return codes.ResourceExhausted
+	case buildah.ErrorClassRateLimited, buildah.ErrorClassNetwork:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
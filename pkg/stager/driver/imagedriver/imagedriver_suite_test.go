@@ -0,0 +1,102 @@
+package imagedriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	clock "k8s.io/utils/clock/testing"
+	"k8s.io/utils/mount"
+)
+
+var (
+	testNodeID = "test-node"
+	fakeNow    = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock  = clock.NewFakeClock(fakeNow)
+)
+
+func TestImageDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Image Driver Test Suite")
+}
+
+func newTestDriver(backend *fake.Backend, mounter mount.Interface, kubeClient kubernetes.Interface) *Driver {
+	volumes := image.NewMemoryVolumeStore()
+	d := &Driver{
+		clock:               fakeClock,
+		nodeID:              testNodeID,
+		kubeClient:          kubeClient,
+		mounter:             mounter,
+		defaultStageInImage: "busybox:latest",
+		volumes:             volumes,
+		volumeLocks:         newVolumeLocks(),
+		stager: &image.Stager{
+			Buildah: backend,
+			Mounter: mounter,
+			Store:   volumes,
+		},
+	}
+	d.stager.OutcomeResolver = d
+	d.stager.Reporter = d
+	d.stager.History = d
+	d.stager.SecretResolver = d
+	return d
+}
+
+func newTestWorkDir() string {
+	workDir, err := ioutil.TempDir("", "imagedriver-test-")
+	Expect(err).NotTo(HaveOccurred())
+	return workDir
+}
+
+// newTestDriverIn creates a driver with a fake backend whose containers are in workDir.
+func newTestDriverIn(workDir string, kubeClient kubernetes.Interface) (*Driver, *fake.Backend) {
+	backend := fake.NewBackend(filepath.Join(workDir, "containers"))
+	return newTestDriver(backend, mount.NewFakeMounter(nil), kubeClient), backend
+}
+
+// newTestRequest returns NodePublishVolumeRequest of a new volume "data" which stages out to
+// registry:5000/test/test:<pod name>. Its pod is test-ns/test-name unless pod is given.
+// attributes are added to the volume context and empty ones remove the keys.
+func newTestRequest(workDir string, pod *corev1.Pod, attributes map[string]string) *csi.NodePublishVolumeRequest {
+	volumeID := uuid.New().String()
+	volumeContext := map[string]string{
+		api.StageOutImageRepoKey:          "registry:5000/test/test",
+		api.StageOutTagGeneratorKey:       "podName",
+		util.PodInfoNamespaceKey:          "test-ns",
+		util.PodInfoNameKey:               "test-name",
+		util.PodInfoUIDKey:                volumeID,
+		util.PodInfoServiceAccountNameKey: "test-sa",
+	}
+	if pod != nil {
+		volumeContext[util.PodInfoNamespaceKey] = pod.Namespace
+		volumeContext[util.PodInfoNameKey] = pod.Name
+		volumeContext[util.PodInfoUIDKey] = string(pod.UID)
+	}
+	for k, v := range attributes {
+		if v == "" {
+			delete(volumeContext, k)
+			continue
+		}
+		volumeContext[k] = v
+	}
+	targetPath := filepath.Join(workDir, "pods", volumeContext[util.PodInfoUIDKey], "volumes", "kubernetes.io~csi", "data", "mount")
+	Expect(os.MkdirAll(targetPath, 0777)).NotTo(HaveOccurred())
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:      volumeID,
+		TargetPath:    targetPath,
+		VolumeContext: volumeContext,
+	}
+}
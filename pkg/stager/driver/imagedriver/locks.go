@@ -0,0 +1,35 @@
+package imagedriver
+
+import (
+	"sync"
+)
+
+// volumeLocks serializes operations on the same volume.
+// Kubelet may retry NodePublishVolume/NodeUnpublishVolume while the previous call is still in flight.
+type volumeLocks struct {
+	mutex sync.Mutex
+	locks map[string]struct{}
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{
+		locks: map[string]struct{}{},
+	}
+}
+
+// TryAcquire acquires the lock of volumeID. It returns false when an operation for the volume is in flight.
+func (l *volumeLocks) TryAcquire(volumeID string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.locks[volumeID]; ok {
+		return false
+	}
+	l.locks[volumeID] = struct{}{}
+	return true
+}
+
+func (l *volumeLocks) Release(volumeID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.locks, volumeID)
+}
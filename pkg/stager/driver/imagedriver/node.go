@@ -2,9 +2,11 @@ package imagedriver
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/rs/zerolog"
 
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
 	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -29,52 +31,88 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	logger := zlog.With().Str("CSIOperation", "NodePublishVolume").Logger()
 	logger.Trace().Interface("request", req).Msg("method called with the request")
 
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		err := errors.New("Volume ID missing in request")
+		logger.Error().Err(err).Msg("invalid argument")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !d.volumeLocks.TryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, "an operation for volumeID=%s is already in progress", volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
+
 	vol, err := d.initVolume(req)
 	if err != nil {
 		logger.Error().Interface("context", req.GetVolumeContext()).Err(err).Msg("failed to initialize volume")
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, err
 	}
 
 	logger = d.LogWithVolume(logger, vol)
 	logger.Debug().Msg("start")
 
 	// publish
-	if err := d.stager.StageIn(vol); err != nil {
+	if err := d.stager.StageIn(ctx, vol); err != nil {
 		logger.Error().Err(err).Msg("failed to stage-in. rolling back...")
 
-		if errRollback := d.stager.RollBackStageIn(vol); errRollback != nil {
+		// roll back even if the request was canceled.
+		if errRollback := d.stager.RollBackStageIn(context.Background(), vol); errRollback != nil {
 			logger.Error().Err(err).Msg("failed to roll back")
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 		logger.Error().Msg("succeeded rolling back")
 
-		d.deleteVolume(vol.VolumeID)
+		if errDelete := d.deleteVolume(vol.VolumeID); errDelete != nil {
+			logger.Error().Err(errDelete).Msg("failed to delete volume")
+		}
 
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, stagerStatusError(err)
 	}
 
 	logger.Debug().Msg("succeeded")
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// initVolume returns the volume to publish. When the volume has already been published with
+// the same parameters, the existing one is returned so that NodePublishVolume is idempotent.
+// Returned errors are gRPC status errors.
 func (d *Driver) initVolume(req *csi.NodePublishVolumeRequest) (*image.Volume, error) {
 	vol, err := image.NewVolume(req, d.clock, d.defaultStageInImage)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if when := vol.Spec.StageOutSpec.When; d.kubeClient == nil && (when == api.StageOutWhenOnSuccess || when == api.StageOutWhenOnFailure) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s=%s requires the driver to access Kubernetes API to know pod outcomes", api.StageOutWhenKey, when)
+	}
+	if err := vol.Spec.NotifySpec.CheckAllowed(d.notifyURLAllowPrefixes); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	if v, ok := d.statuses[vol.VolumeID]; ok {
-		return nil, errors.Errorf("volumeID=%s has not been fully unpublished. phase=%s", v.VolumeID, v.Phase)
+	existing, err := d.volumes.Get(vol.VolumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if existing != nil {
+		if !existing.IsPublishing() {
+			return nil, status.Errorf(codes.FailedPrecondition, "volumeID=%s has not been fully unpublished. phase=%s", existing.VolumeID, existing.Phase)
+		}
+		if !existing.IsSamePublication(vol) {
+			return nil, status.Errorf(codes.AlreadyExists, "volumeID=%s has already been published with different parameters", existing.VolumeID)
+		}
+		existing.SetDockerConfigJson(vol.DockerConfigJson)
+		return existing, nil
+	}
+	if err := d.volumes.Save(vol); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
-	d.statuses[vol.VolumeID] = vol
 	return vol, nil
 }
 
-func (d *Driver) deleteVolume(volumeID string) {
-	delete(d.statuses, volumeID)
+func (d *Driver) deleteVolume(volumeID string) error {
+	return d.volumes.Delete(volumeID)
 }
 
-func (d *Driver) getVolume(volumeID string) *image.Volume {
-	return d.statuses[volumeID]
+func (d *Driver) getVolume(volumeID string) (*image.Volume, error) {
+	return d.volumes.Get(volumeID)
 }
 
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
@@ -87,25 +125,76 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		logger.Error().Err(err).Msg("invalid argument")
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	if !d.volumeLocks.TryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, "an operation for volumeID=%s is already in progress", volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
 
-	vol := d.getVolume(volumeID)
+	vol, err := d.getVolume(volumeID)
+	if err != nil {
+		logger.Error().Err(err).Str("VolumeID", volumeID).Msg("failed to get volume")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	if vol == nil {
-		err := errors.Errorf("volumeID=%s is not initialized", volumeID)
-		logger.Error().Err(err).Msg("assertion error")
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		recovered, err := d.recoverVolume(volumeID, req.GetTargetPath())
+		if err != nil && isUnrecoverable(err) {
+			// retries would fail forever. e.g. the pod was force-deleted.
+			if err := d.discardVolume(volumeID, req.GetTargetPath(), err); err != nil {
+				logger.Error().Err(err).Str("VolumeID", volumeID).Msg("failed to discard volume")
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			return &csi.NodeUnpublishVolumeResponse{}, nil
+		}
+		if err != nil {
+			// kubelet forgets the volume once this succeeds. fail so that its container is staged out on retries.
+			logger.Error().Err(err).Str("VolumeID", volumeID).Msg("failed to recover volume")
+			return nil, status.Errorf(codes.Unavailable, "can't recover volume(volumeID=%s): %s", volumeID, err.Error())
+		}
+		if recovered != nil {
+			if err := d.volumes.Save(recovered); err != nil {
+				logger.Error().Err(err).Str("VolumeID", volumeID).Msg("failed to save recovered volume")
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			vol = recovered
+		}
+	}
+	if vol == nil {
+		logger.Debug().Str("VolumeID", volumeID).Msg("volume has already been unpublished")
+		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
 	logger = d.LogWithVolume(logger, vol)
 	logger.Debug().Msg("start")
 
-	if err := d.stager.StageOut(vol); err != nil {
+	if d.stageOutQueue != nil {
+		// the pod may be gone when the queued stage-out runs.
+		if err := d.stager.ResolvePodOutcome(vol); err != nil {
+			logger.Error().Err(err).Msg("failed to resolve pod outcome")
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		if err := d.stager.UnmountTargetPath(vol); err != nil {
+			logger.Error().Err(err).Msg("failed to unmount targetPath")
+			return nil, stagerStatusError(err)
+		}
+		d.stageOutQueue.Add(volumeID)
+		d.stager.PublishEventIfSupported(vol, "StageOutQueued", fmt.Sprintf("volumeID=%s", volumeID))
+		logger.Debug().Msg("succeeded. stage-out was queued")
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	d.ensureDockerConfigJson(vol, logger)
+
+	if err := d.stager.StageOut(ctx, vol); err != nil {
 		logger.Error().Err(err).Msg("failed to stage-out")
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, stagerStatusError(err)
 	}
 
-	d.deleteVolume(volumeID)
+	if err := d.deleteVolume(volumeID); err != nil {
+		logger.Error().Err(err).Msg("failed to delete volume")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
-	logger.Debug().Msg("succeeded")
+	logger.Debug().Str("PushedImage", vol.PushedImage()).Msg("succeeded")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -0,0 +1,235 @@
+package imagedriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Node Service", func() {
+	var workDir string
+	var backend *fake.Backend
+	var driver *Driver
+
+	// volumes which don't stage out
+	publishRequest := func() *csi.NodePublishVolumeRequest {
+		return newTestRequest(workDir, nil, map[string]string{api.StageOutImageRepoKey: "", api.StageOutTagGeneratorKey: ""})
+	}
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+		driver, backend = newTestDriverIn(workDir, nil)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should publish and unpublish volumes", func() {
+		req := publishRequest()
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vol.Phase).Should(Equal(image.PhasePublished))
+
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(driver.getVolume(req.VolumeId)).To(BeNil())
+		Expect(backend.Container(req.VolumeId)).To(BeNil())
+	})
+
+	DescribeTable("status codes of stage-in failures",
+		func(fromErr error, expected codes.Code) {
+			req := publishRequest()
+			backend.SetError("From", fromErr)
+			_, err := driver.NodePublishVolume(context.Background(), req)
+			Expect(status.Code(err)).Should(Equal(expected))
+			Expect(driver.getVolume(req.VolumeId)).To(BeNil())
+		},
+		Entry("auth", &buildah.Error{Class: buildah.ErrorClassAuth}, codes.PermissionDenied),
+		Entry("not found", &buildah.Error{Class: buildah.ErrorClassNotFound}, codes.NotFound),
+		Entry("timeout", &buildah.Error{Class: buildah.ErrorClassTimeout}, codes.DeadlineExceeded),
+		Entry("storage exhausted", &buildah.Error{Class: buildah.ErrorClassStorageExhausted}, codes.ResourceExhausted),
+		Entry("network", &buildah.Error{Class: buildah.ErrorClassNetwork}, codes.Unavailable),
+		Entry("unknown", errors.New("unknown"), codes.Internal),
+	)
+
+	It("should fail with Canceled and roll back when the request is canceled", func() {
+		req := publishRequest()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := driver.NodePublishVolume(ctx, req)
+		Expect(status.Code(err)).Should(Equal(codes.Canceled))
+		Expect(driver.getVolume(req.VolumeId)).To(BeNil())
+		Expect(backend.Container(req.VolumeId)).To(BeNil())
+	})
+
+	It("should fail with PermissionDenied when push is denied", func() {
+		req := publishRequest()
+		req.VolumeContext[api.StageOutImageRepoKey] = "registry:5000/test/test"
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		backend.SetError("Push", &buildah.Error{Class: buildah.ErrorClassAuth})
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		Expect(status.Code(err)).Should(Equal(codes.PermissionDenied))
+	})
+
+	DescribeTable("notify/url",
+		func(allowPrefix, notifyURL string, expected codes.Code) {
+			driver.notifyURLAllowPrefixes = []string{allowPrefix}
+			req := publishRequest()
+			req.VolumeContext[api.NotifyURLKey] = notifyURL
+			_, err := driver.NodePublishVolume(context.Background(), req)
+			Expect(status.Code(err)).Should(Equal(expected))
+		},
+		Entry("allowed", "https://hooks.example.com/", "https://hooks.example.com/stager", codes.OK),
+		Entry("other host with the same prefix", "https://hooks.example.com/", "https://hooks.example.com.attacker.io/stager", codes.InvalidArgument),
+		Entry("metadata endpoint", "https://hooks.example.com/", "http://169.254.169.254/latest/meta-data", codes.InvalidArgument),
+		Entry("allowed by the host", "https://hooks.example.com", "https://hooks.example.com/stager", codes.OK),
+		Entry("lookalike host", "https://hooks.example.com", "https://hooks.example.com.attacker.net/", codes.InvalidArgument),
+		Entry("lookalike port", "https://hooks.example.com", "https://hooks.example.com:8443/stager", codes.InvalidArgument),
+		Entry("userinfo", "https://hooks.example.com", "https://hooks.example.com@attacker.net/", codes.InvalidArgument),
+		Entry("other scheme", "https://hooks.example.com", "http://hooks.example.com/stager", codes.InvalidArgument),
+		Entry("allowed path", "https://hooks.example.com/stager", "https://hooks.example.com/stager/events", codes.OK),
+		Entry("lookalike path", "https://hooks.example.com/stager", "https://hooks.example.com/stager-attacker", codes.InvalidArgument),
+	)
+
+	It("should reject notify/url without allowed prefixes", func() {
+		req := publishRequest()
+		req.VolumeContext[api.NotifyURLKey] = "https://hooks.example.com/stager"
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(status.Code(err)).Should(Equal(codes.InvalidArgument))
+		Expect(driver.getVolume(req.VolumeId)).To(BeNil())
+	})
+
+	Context("idempotency", func() {
+		It("should succeed when the volume is republished with the same parameters", func() {
+			req := publishRequest()
+			_, err := driver.NodePublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = driver.NodePublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+			vol, err := driver.getVolume(req.VolumeId)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhasePublished))
+		})
+
+		It("should resume publishing when the previous call was interrupted", func() {
+			req := publishRequest()
+			backend.SetError("Mount", errors.New("interrupted"))
+			vol, err := driver.initVolume(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(driver.stager.StageIn(context.Background(), vol)).To(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseContainerCreated))
+
+			backend.SetError("Mount", nil)
+			_, err = driver.NodePublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhasePublished))
+		})
+
+		It("should fail with AlreadyExists when the volume is republished with different parameters", func() {
+			req := publishRequest()
+			_, err := driver.NodePublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+
+			targetPath := req.TargetPath
+			req.TargetPath = filepath.Join(workDir, "targetpath", "another")
+			_, err = driver.NodePublishVolume(context.Background(), req)
+			Expect(status.Code(err)).Should(Equal(codes.AlreadyExists))
+
+			req.TargetPath = targetPath
+			req.Readonly = true
+			_, err = driver.NodePublishVolume(context.Background(), req)
+			Expect(status.Code(err)).Should(Equal(codes.AlreadyExists))
+		})
+
+		It("should succeed when the volume has already been unpublished", func() {
+			req := publishRequest()
+			unpublishReq := &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   req.VolumeId,
+				TargetPath: req.TargetPath,
+			}
+			_, err := driver.NodeUnpublishVolume(context.Background(), unpublishReq)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = driver.NodePublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = driver.NodeUnpublishVolume(context.Background(), unpublishReq)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = driver.NodeUnpublishVolume(context.Background(), unpublishReq)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	It("should abort operations for a volume which has an operation in flight", func() {
+		req := publishRequest()
+		Expect(driver.volumeLocks.TryAcquire(req.VolumeId)).Should(BeTrue())
+
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(status.Code(err)).Should(Equal(codes.Aborted))
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		Expect(status.Code(err)).Should(Equal(codes.Aborted))
+
+		driver.volumeLocks.Release(req.VolumeId)
+		_, err = driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should handle operations for different volumes concurrently", func() {
+		n := 10
+		reqs := make([]*csi.NodePublishVolumeRequest, n)
+		for i := range reqs {
+			reqs[i] = publishRequest()
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for _, req := range reqs {
+			wg.Add(1)
+			go func(req *csi.NodePublishVolumeRequest) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				if _, err := driver.NodePublishVolume(context.Background(), req); err != nil {
+					errs <- err
+					return
+				}
+				_, err := driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+					VolumeId:   req.VolumeId,
+					TargetPath: req.TargetPath,
+				})
+				errs <- err
+			}(req)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(driver.volumes.List()).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,52 @@
+package imagedriver
+
+import (
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ image.PodOutcomeResolver = &Driver{}
+
+// PodOutcome looks up the exit codes of the volume's pod containers.
+func (d *Driver) PodOutcome(vol *image.Volume) (image.PodOutcome, error) {
+	if d.kubeClient == nil {
+		return image.PodOutcomeUnknown, nil
+	}
+	pod, err := d.kubeClient.CoreV1().Pods(vol.PodInfo.Namespace).Get(vol.PodInfo.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return image.PodOutcomeNotFound, nil
+	}
+	if err != nil {
+		return image.PodOutcomeUnknown, errors.Wrapf(err, "can't get pod(%s/%s)", vol.PodInfo.Namespace, vol.PodInfo.Name)
+	}
+	if pod.UID != vol.PodInfo.UID {
+		return image.PodOutcomeNotFound, nil
+	}
+	return podOutcome(pod), nil
+}
+
+// podOutcome returns Failed when any container exited with non-zero code, and Succeeded when all containers exited with zero.
+// Containers which never ran (e.g. ImagePullBackOff) never terminate, so the pod failed once it's deleted or failed.
+func podOutcome(pod *corev1.Pod) image.PodOutcome {
+	outcome := image.PodOutcomeSucceeded
+	if len(pod.Status.ContainerStatuses) == 0 {
+		outcome = image.PodOutcomeUnknown
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+		if terminated == nil {
+			outcome = image.PodOutcomeUnknown
+			continue
+		}
+		if terminated.ExitCode != 0 {
+			return image.PodOutcomeFailed
+		}
+	}
+	if outcome == image.PodOutcomeUnknown && (pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodFailed) {
+		return image.PodOutcomeFailed
+	}
+	return outcome
+}
@@ -0,0 +1,207 @@
+package imagedriver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+var _ = Describe("Conditional stage-out", func() {
+	var workDir string
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	terminated := func(exitCodes ...int32) []corev1.ContainerStatus {
+		statuses := []corev1.ContainerStatus{}
+		for _, exitCode := range exitCodes {
+			statuses = append(statuses, corev1.ContainerStatus{
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode}},
+			})
+		}
+		return statuses
+	}
+
+	DescribeTable("stage-out/when",
+		func(when, repositoryOnFailure string, statuses []corev1.ContainerStatus, expectedPushed []string) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: types.UID(uuid.New().String())},
+				Spec:       corev1.PodSpec{NodeName: testNodeID},
+				Status:     corev1.PodStatus{ContainerStatuses: statuses},
+			}
+			driver, backend := newTestDriverIn(workDir, kubefake.NewSimpleClientset(pod))
+			recorder := record.NewFakeRecorder(100)
+			driver.stager.Recorder = recorder
+
+			req := newTestRequest(workDir, pod, map[string]string{
+				api.StageOutWhenKey:                when,
+				api.StageOutRepositoryOnFailureKey: repositoryOnFailure,
+			})
+			_, err := driver.NodePublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   req.VolumeId,
+				TargetPath: req.TargetPath,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.Pushed()).Should(Equal(expectedPushed))
+			Expect(backend.Container(req.VolumeId)).To(BeNil())
+			if len(expectedPushed) == 0 {
+				Eventually(recorder.Events).Should(Receive(ContainSubstring("StageOutSkipped")))
+			}
+		},
+		Entry("Always pushes failed pods", api.StageOutWhenAlways, "", terminated(0, 1), []string{"registry:5000/test/test:test-name"}),
+		Entry("Always pushes failed pods to repositoryOnFailure", api.StageOutWhenAlways, "registry:5000/test/failed", terminated(0, 1), []string{"registry:5000/test/failed:test-name"}),
+		Entry("OnSuccess pushes succeeded pods", api.StageOutWhenOnSuccess, "", terminated(0, 0), []string{"registry:5000/test/test:test-name"}),
+		Entry("OnSuccess skips failed pods", api.StageOutWhenOnSuccess, "", terminated(0, 137), []string{}),
+		Entry("OnFailure pushes failed pods to repositoryOnFailure", api.StageOutWhenOnFailure, "registry:5000/test/failed", terminated(2), []string{"registry:5000/test/failed:test-name"}),
+		Entry("OnFailure skips succeeded pods", api.StageOutWhenOnFailure, "", terminated(0), []string{}),
+		Entry("Never skips", api.StageOutWhenNever, "", terminated(0), []string{}),
+	)
+
+	It("should fail unpublishing while the pod outcome is unknown", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: types.UID(uuid.New().String())},
+			Spec:       corev1.PodSpec{NodeName: testNodeID},
+		}
+		kubeClient := kubefake.NewSimpleClientset(pod)
+		driver, backend := newTestDriverIn(workDir, kubeClient)
+
+		req := newTestRequest(workDir, pod, map[string]string{api.StageOutWhenKey: api.StageOutWhenOnSuccess})
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		unpublishReq := &csi.NodeUnpublishVolumeRequest{VolumeId: req.VolumeId, TargetPath: req.TargetPath}
+		_, err = driver.NodeUnpublishVolume(context.Background(), unpublishReq)
+		Expect(err).To(HaveOccurred())
+		Expect(backend.Pushed()).Should(BeEmpty())
+		Expect(backend.Container(req.VolumeId)).NotTo(BeNil())
+
+		pod.Status.ContainerStatuses = terminated(0)
+		_, err = kubeClient.CoreV1().Pods(pod.Namespace).UpdateStatus(pod)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = driver.NodeUnpublishVolume(context.Background(), unpublishReq)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+	})
+
+	stageOutFinally := func(pod *corev1.Pod, attributes map[string]string, deletePod bool) (*fake.Backend, *record.FakeRecorder) {
+		kubeClient := kubefake.NewSimpleClientset(pod)
+		driver, backend := newTestDriverIn(workDir, kubeClient)
+		recorder := record.NewFakeRecorder(100)
+		driver.stager.Recorder = recorder
+
+		req := newTestRequest(workDir, pod, attributes)
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		if deletePod {
+			Expect(kubeClient.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})).NotTo(HaveOccurred())
+		}
+
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: req.VolumeId, TargetPath: req.TargetPath})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Container(req.VolumeId)).To(BeNil())
+		return backend, recorder
+	}
+
+	It("should skip stage-out when the pod was gone before its outcome was known", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: types.UID(uuid.New().String())},
+			Spec:       corev1.PodSpec{NodeName: testNodeID},
+		}
+		backend, recorder := stageOutFinally(pod, map[string]string{api.StageOutWhenKey: api.StageOutWhenOnSuccess}, true)
+		Expect(backend.Pushed()).Should(BeEmpty())
+		Eventually(recorder.Events).Should(Receive(And(ContainSubstring("StageOutSkipped"), ContainSubstring("pod outcome is NotFound"))))
+	})
+
+	It("should treat deleted pods whose containers never ran as failed", func() {
+		deletedAt := metav1.Now()
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: types.UID(uuid.New().String()), DeletionTimestamp: &deletedAt},
+			Spec:       corev1.PodSpec{NodeName: testNodeID},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+			}}},
+		}
+		backend, _ := stageOutFinally(pod, map[string]string{
+			api.StageOutWhenKey:                api.StageOutWhenOnFailure,
+			api.StageOutRepositoryOnFailureKey: "registry:5000/test/failed",
+		}, false)
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/failed:test-name"}))
+	})
+
+	It("should reject stage-out/when=OnSuccess without Kubernetes API", func() {
+		driver, _ := newTestDriverIn(workDir, nil)
+		req := newTestRequest(workDir, nil, map[string]string{
+			api.StageOutTagGeneratorKey: "",
+			api.StageOutWhenKey:         api.StageOutWhenOnSuccess,
+		})
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(status.Code(err)).Should(Equal(codes.InvalidArgument))
+	})
+})
+
+var _ = Describe("Stage-out of unchanged volumes", func() {
+	var workDir string
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("stage-out/skipIfUnchanged",
+		func(skipIfUnchanged string, modify bool, expectedPushed []string) {
+			driver, backend := newTestDriverIn(workDir, kubefake.NewSimpleClientset())
+			recorder := record.NewFakeRecorder(100)
+			driver.stager.Recorder = recorder
+
+			req := newTestRequest(workDir, nil, map[string]string{api.StageOutSkipIfUnchangedKey: skipIfUnchanged})
+			_, err := driver.NodePublishVolume(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+			if modify {
+				mountPoint := backend.Container(req.VolumeId).MountPoint
+				Expect(ioutil.WriteFile(filepath.Join(mountPoint, "output"), []byte("test"), 0644)).NotTo(HaveOccurred())
+			}
+
+			_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   req.VolumeId,
+				TargetPath: req.TargetPath,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backend.Pushed()).Should(Equal(expectedPushed))
+			Expect(backend.Images()).Should(HaveLen(len(expectedPushed)))
+			Expect(backend.Container(req.VolumeId)).To(BeNil())
+			if len(expectedPushed) == 0 {
+				Eventually(recorder.Events).Should(Receive(ContainSubstring("unchanged")))
+			}
+		},
+		Entry("skips unchanged volumes", "true", false, []string{}),
+		Entry("pushes modified volumes", "true", true, []string{"registry:5000/test/test:test-name"}),
+		Entry("pushes unchanged volumes by default", "", false, []string{"registry:5000/test/test:test-name"}),
+	)
+})
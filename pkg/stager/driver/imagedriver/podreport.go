@@ -0,0 +1,144 @@
+package imagedriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ image.PodReporter = &Driver{}
+
+// ReportToPod annotates the pod with the result and updates its StageOutCompleted condition.
+// Pods which no longer exist are ignored.
+func (d *Driver) ReportToPod(result image.StageResult) error {
+	if d.kubeClient == nil {
+		return nil
+	}
+	annotations := map[string]string{}
+	annotate := func(prefix, value string) {
+		if value != "" {
+			annotations[prefix+result.VolumeName] = value
+		}
+	}
+	annotate(api.StageInImageAnnotationPrefix, result.StageInImage)
+	annotate(api.StageInDigestAnnotationPrefix, result.StageInDigest)
+	annotate(api.StageOutImageAnnotationPrefix, result.StageOutImage)
+	annotate(api.StageOutDigestAnnotationPrefix, result.StageOutDigest)
+	annotate(api.StageOutStatusAnnotationPrefix, string(result.StageOutStatus))
+	if len(result.Destinations) > 0 {
+		destinations, err := json.Marshal(result.Destinations)
+		if err != nil {
+			return errors.Wrap(err, "can't marshal destinations")
+		}
+		annotate(api.StageOutDestinationsAnnotationPrefix, string(destinations))
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	metadata := map[string]interface{}{"annotations": annotations}
+	// the uid works as a precondition so that a new pod with the same name isn't annotated.
+	if result.Pod.UID != "" {
+		metadata["uid"] = result.Pod.UID
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return errors.Wrap(err, "can't marshal annotations patch")
+	}
+	pods := d.kubeClient.CoreV1().Pods(result.Pod.Namespace)
+	pod, err := pods.Patch(result.Pod.Name, types.MergePatchType, patch)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "can't annotate pod(%s/%s)", result.Pod.Namespace, result.Pod.Name)
+	}
+	if result.StageOutStatus == "" {
+		return nil
+	}
+
+	condition := d.stageOutCompletedCondition(pod)
+	if condition == nil {
+		return nil
+	}
+	patch, err = json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"conditions": []corev1.PodCondition{*condition}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't marshal condition patch")
+	}
+	_, err = pods.Patch(result.Pod.Name, types.StrategicMergePatchType, patch, "status")
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "can't update %s condition of pod(%s/%s)", api.StageOutCompletedCondition, result.Pod.Namespace, result.Pod.Name)
+	}
+	return nil
+}
+
+// stageOutCompletedCondition is True when all the pod's volumes with stage-out/repository completed stage-out.
+// It returns nil when the pod already has the same condition.
+func (d *Driver) stageOutCompletedCondition(pod *corev1.Pod) *corev1.PodCondition {
+	var failed, pending []string
+	for _, v := range pod.Spec.Volumes {
+		if v.CSI == nil || v.CSI.Driver != DriverName {
+			continue
+		}
+		if _, ok := v.CSI.VolumeAttributes[api.StageOutImageRepoKey]; !ok {
+			continue
+		}
+		status := api.StageOutStatus(pod.Annotations[api.StageOutStatusAnnotationPrefix+v.Name])
+		switch {
+		case status.IsCompleted():
+		case status == api.StageOutStatusFailed:
+			failed = append(failed, v.Name)
+		default:
+			pending = append(pending, v.Name)
+		}
+	}
+	sort.Strings(failed)
+	sort.Strings(pending)
+
+	condition := &corev1.PodCondition{
+		Type:    corev1.PodConditionType(api.StageOutCompletedCondition),
+		Status:  corev1.ConditionTrue,
+		Reason:  "Completed",
+		Message: "all volumes were staged out",
+	}
+	switch {
+	case len(failed) > 0:
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "Failed"
+		condition.Message = fmt.Sprintf("stage-out failed: volumes=%s", strings.Join(failed, ","))
+	case len(pending) > 0:
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "Pending"
+		condition.Message = fmt.Sprintf("waiting for stage-out: volumes=%s", strings.Join(pending, ","))
+	}
+
+	now := metav1.NewTime(d.clock.Now())
+	condition.LastProbeTime = now
+	condition.LastTransitionTime = now
+	for _, c := range pod.Status.Conditions {
+		if c.Type != condition.Type {
+			continue
+		}
+		if c.Status == condition.Status && c.Reason == condition.Reason && c.Message == condition.Message {
+			return nil
+		}
+		if c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+	return condition
+}
@@ -0,0 +1,157 @@
+package imagedriver
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("Reporting stage results to pods", func() {
+	var workDir string
+	var backend *fake.Backend
+	var kubeClient kubernetes.Interface
+	var driver *Driver
+	var pod *corev1.Pod
+
+	stagerVolume := func(name string, attributes map[string]string) corev1.Volume {
+		return corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				CSI: &corev1.CSIVolumeSource{Driver: DriverName, VolumeAttributes: attributes},
+			},
+		}
+	}
+
+	publish := func(volumeName string) *csi.NodePublishVolumeRequest {
+		// only the attributes of the pod's volume
+		attributes := map[string]string{api.StageOutImageRepoKey: "", api.StageOutTagGeneratorKey: ""}
+		for _, v := range pod.Spec.Volumes {
+			if v.Name == volumeName {
+				for k, a := range v.CSI.VolumeAttributes {
+					attributes[k] = a
+				}
+			}
+		}
+		req := newTestRequest(workDir, pod, attributes)
+		req.TargetPath = filepath.Join(workDir, "pods", string(pod.UID), "volumes", "kubernetes.io~csi", volumeName, "mount")
+		Expect(os.MkdirAll(req.TargetPath, 0777)).NotTo(HaveOccurred())
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		return req
+	}
+
+	unpublish := func(req *csi.NodePublishVolumeRequest) {
+		_, err := driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	getPod := func() *corev1.Pod {
+		p, err := kubeClient.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return p
+	}
+
+	stageOutCompleted := func() *corev1.PodCondition {
+		for _, c := range getPod().Status.Conditions {
+			if c.Type == api.StageOutCompletedCondition {
+				return &c
+			}
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: types.UID(uuid.New().String())},
+			Spec: corev1.PodSpec{
+				NodeName: testNodeID,
+				Volumes: []corev1.Volume{
+					stagerVolume("data", map[string]string{
+						api.StageInImageKey:         "registry:5000/test/input:v1",
+						api.StageOutImageRepoKey:    "registry:5000/test/test",
+						api.StageOutTagGeneratorKey: "podName",
+					}),
+					stagerVolume("logs", map[string]string{
+						api.StageOutImageRepoKey: "registry:5000/test/logs",
+						api.StageOutWhenKey:      api.StageOutWhenNever,
+					}),
+					stagerVolume("scratch", map[string]string{}),
+				},
+			},
+		}
+		kubeClient = kubefake.NewSimpleClientset(pod)
+		driver, backend = newTestDriverIn(workDir, kubeClient)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should annotate the pod with stage-in and stage-out results", func() {
+		data := publish("data")
+		logs := publish("logs")
+		annotations := getPod().Annotations
+		Expect(annotations).Should(HaveKeyWithValue(api.StageInImageAnnotationPrefix+"data", "registry:5000/test/input:v1"))
+		Expect(annotations).Should(HaveKeyWithValue(api.StageInDigestAnnotationPrefix+"data", fake.Digest("registry:5000/test/input:v1")))
+		Expect(annotations).Should(HaveKeyWithValue(api.StageInImageAnnotationPrefix+"logs", "busybox:latest"))
+		Expect(stageOutCompleted()).To(BeNil())
+
+		unpublish(data)
+		annotations = getPod().Annotations
+		Expect(annotations).Should(HaveKeyWithValue(api.StageOutImageAnnotationPrefix+"data", "registry:5000/test/test:test-name"))
+		Expect(annotations).Should(HaveKeyWithValue(api.StageOutDigestAnnotationPrefix+"data", fake.Digest("registry:5000/test/test:test-name")))
+		Expect(annotations).Should(HaveKeyWithValue(api.StageOutStatusAnnotationPrefix+"data", string(api.StageOutStatusSucceeded)))
+		condition := stageOutCompleted()
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).Should(Equal(corev1.ConditionFalse))
+		Expect(condition.Reason).Should(Equal("Pending"))
+		Expect(condition.Message).Should(ContainSubstring("logs"))
+
+		unpublish(logs)
+		Expect(getPod().Annotations).Should(HaveKeyWithValue(api.StageOutStatusAnnotationPrefix+"logs", string(api.StageOutStatusSkipped)))
+		condition = stageOutCompleted()
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).Should(Equal(corev1.ConditionTrue))
+	})
+
+	It("should annotate the pod with destinations when stage-out pushes to mirror repositories", func() {
+		pod.Spec.Volumes[0].CSI.VolumeAttributes[api.StageOutOptionalMirrorRepositoriesKey] = "cache:5000/test/test"
+		backend.SetRegistryError("cache:5000", errors.New("cache is down"))
+		unpublish(publish("data"))
+
+		annotations := getPod().Annotations
+		Expect(annotations).Should(HaveKeyWithValue(api.StageOutStatusAnnotationPrefix+"data", string(api.StageOutStatusSucceeded)))
+		destinations := []image.Destination{}
+		Expect(json.Unmarshal([]byte(annotations[api.StageOutDestinationsAnnotationPrefix+"data"]), &destinations)).NotTo(HaveOccurred())
+		Expect(destinations).Should(Equal([]image.Destination{
+			{Image: "registry:5000/test/test:test-name", Required: true, Pushed: true, Digest: fake.Digest("registry:5000/test/test:test-name")},
+			{Image: "cache:5000/test/test:test-name", Error: "can't push image(=cache:5000/test/test:test-name): cache is down"},
+		}))
+	})
+
+	It("should ignore pods which no longer exist", func() {
+		req := publish("data")
+		Expect(kubeClient.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})).NotTo(HaveOccurred())
+		unpublish(req)
+		Expect(backend.Pushed()).Should(HaveLen(1))
+	})
+})
@@ -0,0 +1,130 @@
+package imagedriver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	zlog "github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const podInformerResyncPeriod = 10 * time.Minute
+
+// startPodInformer watches pods on the node and stages out volumes with stage-out/trigger=OnCompletion
+// when their pods complete. It doesn't wait for the informer cache to sync so that the driver starts serving
+// immediately. Pods are handled only after the cache synced.
+func (d *Driver) startPodInformer(stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		d.kubeClient, podInformerResyncPeriod,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", d.nodeID).String()
+		}),
+	)
+	podInformer := factory.Core().V1().Pods().Informer()
+	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if podInformer.HasSynced() {
+				d.onPodUpdate(obj)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if podInformer.HasSynced() {
+				d.onPodUpdate(newObj)
+			}
+		},
+	})
+	factory.Start(stop)
+	go func() {
+		if !cache.WaitForCacheSync(stop, podInformer.HasSynced) {
+			return
+		}
+		zlog.Info().Msg("pod informer synced")
+		// pods delivered before the cache synced were ignored.
+		for _, obj := range podInformer.GetStore().List() {
+			d.onPodUpdate(obj)
+		}
+	}()
+	zlog.Info().Msg("started pod informer")
+}
+
+func (d *Driver) onPodUpdate(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || !isPodCompleted(pod) {
+		return
+	}
+	volumes, err := d.volumes.List()
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to list volumes")
+		return
+	}
+	// only PodInfo, which never changes, is read here because volumes are shared without their locks.
+	// processCompletedVolume checks the rest under the lock.
+	for _, vol := range volumes {
+		if vol.PodInfo.UID == pod.UID {
+			d.completionQueue.Add(vol.VolumeID)
+		}
+	}
+}
+
+// isPodCompleted returns true when all the pod's containers terminated and won't be restarted.
+func isPodCompleted(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+func isWaitingForCompletion(vol *image.Volume) bool {
+	return vol.Phase == image.PhasePublished &&
+		vol.Spec.StageOutSpec.Enabled &&
+		vol.Spec.StageOutSpec.Trigger == api.StageOutTriggerOnCompletion &&
+		!vol.StagedOut
+}
+
+// processCompletedVolume commits and pushes the volume whose pod completed.
+func (d *Driver) processCompletedVolume(volumeID string) error {
+	if !d.volumeLocks.TryAcquire(volumeID) {
+		return errVolumeBusy
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	vol, err := d.getVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	if vol == nil || !isWaitingForCompletion(vol) {
+		return nil
+	}
+
+	logger := d.LogWithVolume(zlog.With().Str("Operation", "StageOutOnCompletion").Logger(), vol)
+	logger.Debug().Msg("start")
+
+	d.ensureDockerConfigJson(vol, logger)
+
+	if err := d.stager.StageOutPublished(context.Background(), vol); err != nil {
+		return err
+	}
+
+	logger.Debug().Str("PushedImage", vol.PushedImage()).Msg("succeeded")
+	return nil
+}
+
+// abandonCompletedVolume leaves the volume as is. It is staged out when it is unpublished.
+func (d *Driver) abandonCompletedVolume(volumeID string, err error) {
+	// the in-flight operation (e.g. unpublishing) reports its own result.
+	if !d.volumeLocks.TryAcquire(volumeID) {
+		zlog.Debug().Str("VolumeID", volumeID).Msg("volume is busy. skip reporting the abandoned stage-out on completion")
+		return
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	vol, errGet := d.getVolume(volumeID)
+	if errGet != nil || vol == nil {
+		return
+	}
+	d.stager.PublishEventIfSupported(vol, "StageOutFailed", fmt.Sprintf("volumeID=%s gave up stage-out on completion. it will be retried on unpublish: error=%s", volumeID, err.Error()))
+}
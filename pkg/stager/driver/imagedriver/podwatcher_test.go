@@ -0,0 +1,133 @@
+package imagedriver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("Stage-out on completion", func() {
+	var workDir string
+	var backend *fake.Backend
+	var kubeClient kubernetes.Interface
+	var driver *Driver
+	var pod *corev1.Pod
+	var stop chan struct{}
+
+	publish := func(trigger string) *csi.NodePublishVolumeRequest {
+		req := newTestRequest(workDir, pod, map[string]string{api.StageOutTriggerKey: trigger})
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		return req
+	}
+
+	completePod := func() {
+		pod.Status.Phase = corev1.PodSucceeded
+		_, err := kubeClient.CoreV1().Pods(pod.Namespace).UpdateStatus(pod)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: types.UID(uuid.New().String())},
+			Spec:       corev1.PodSpec{NodeName: testNodeID},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+		kubeClient = kubefake.NewSimpleClientset(pod)
+		driver, backend = newTestDriverIn(workDir, kubeClient)
+		driver.completionQueue = newStageOutQueue(3, time.Millisecond, 10*time.Millisecond, driver.processCompletedVolume, driver.abandonCompletedVolume)
+		go driver.completionQueue.Run(1)
+		stop = make(chan struct{})
+		driver.startPodInformer(stop)
+	})
+
+	AfterEach(func() {
+		close(stop)
+		driver.completionQueue.ShutDown()
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should push the image when the pod completed and only clean up on unpublish", func() {
+		req := publish(api.StageOutTriggerOnCompletion)
+		Consistently(backend.Pushed, 50*time.Millisecond).Should(BeEmpty())
+
+		completePod()
+		Eventually(backend.Pushed).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+		Eventually(func() bool {
+			// the volume is shared with the queue worker.
+			if !driver.volumeLocks.TryAcquire(req.VolumeId) {
+				return false
+			}
+			defer driver.volumeLocks.Release(req.VolumeId)
+			vol, err := driver.getVolume(req.VolumeId)
+			Expect(err).NotTo(HaveOccurred())
+			return vol.StagedOut
+		}).Should(BeTrue())
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vol.PushedImage()).Should(Equal("registry:5000/test/test@" + fake.Digest("registry:5000/test/test:test-name")))
+
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Pushed()).Should(HaveLen(1))
+		Expect(backend.Container(req.VolumeId)).To(BeNil())
+		Expect(driver.getVolume(req.VolumeId)).To(BeNil())
+	})
+
+	It("should push the image of the pod which completed before the informer synced", func() {
+		close(stop)
+		publish(api.StageOutTriggerOnCompletion)
+		completePod()
+
+		stop = make(chan struct{})
+		driver.startPodInformer(stop)
+		Eventually(backend.Pushed).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+	})
+
+	It("should commit the image once while pushing it on completion is retried", func() {
+		req := publish(api.StageOutTriggerOnCompletion)
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+
+		backend.SetError("Push", errors.New("registry is down"))
+		Expect(driver.stager.StageOutPublished(context.Background(), vol)).To(HaveOccurred())
+		backend.SetError("Push", nil)
+		Expect(driver.stager.StageOutPublished(context.Background(), vol)).NotTo(HaveOccurred())
+
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Commits("registry:5000/test/test:test-name")).Should(Equal(1))
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+	})
+
+	It("should not push the image on completion by default", func() {
+		req := publish(api.StageOutTriggerOnUnpublish)
+		completePod()
+		Consistently(backend.Pushed, 50*time.Millisecond).Should(BeEmpty())
+
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vol.Phase).Should(Equal(image.PhasePublished))
+	})
+})
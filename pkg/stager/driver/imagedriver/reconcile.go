@@ -0,0 +1,278 @@
+package imagedriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// reconcileVolumes rebuilds the volume table after the driver restarted.
+// Volumes restored from the volume store get their secrets back from kubernetes.
+// For volumes not in the store, buildah containers are looked up instead. They are named after
+// volume IDs. So, a mounted container which is still bind-mounted to kubelet's targetPath is
+// resumed as a published volume.
+func (d *Driver) reconcileVolumes() error {
+	logger := zlog.With().Str("Operation", "ReconcileVolumes").Logger()
+
+	restored, err := d.volumes.List()
+	if err != nil {
+		return errors.Wrap(err, "can't list stored volumes")
+	}
+	for _, vol := range restored {
+		logger := d.LogWithVolume(logger, vol)
+		if vol.IsDockerConfigJsonMissing() {
+			if err := d.restoreDockerConfigJson(vol); err != nil {
+				logger.Error().Err(err).Msg("can't restore docker config json of the volume")
+			}
+		}
+		logger.Info().Str("Phase", string(vol.Phase)).Msg("restored volume")
+	}
+
+	containers, err := d.stager.Buildah.ListContainers(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "can't list Buildah containers")
+	}
+
+	for volumeID, mountPoint := range containers {
+		logger := logger.With().Str("VolumeID", volumeID).Str("MountPoint", mountPoint).Logger()
+		if vol, err := d.getVolume(volumeID); err != nil || vol != nil {
+			continue
+		}
+		if mountPoint == "" {
+			logger.Info().Msg("skip recovering volume because its container is not mounted")
+			continue
+		}
+
+		targetPath, err := d.findTargetPath(mountPoint)
+		if err != nil {
+			logger.Error().Err(err).Msg("can't find targetPath of the container")
+			continue
+		}
+		if targetPath == "" {
+			logger.Info().Msg("skip recovering volume because its container is not mounted to any targetPath")
+			continue
+		}
+
+		vol, err := d.resumeVolume(volumeID, targetPath, mountPoint)
+		if err != nil {
+			logger.Error().Err(err).Str("TargetPath", targetPath).Msg("can't recover volume")
+			continue
+		}
+		if err := d.volumes.Save(vol); err != nil {
+			logger.Error().Err(err).Msg("can't save recovered volume")
+			continue
+		}
+		logger = d.LogWithVolume(logger, vol)
+		logger.Info().Str("Phase", string(vol.Phase)).Msg("recovered volume")
+	}
+	return nil
+}
+
+// findTargetPath returns kubelet's targetPath which the mountPoint is bind-mounted to.
+// It returns empty string when no such targetPath exists.
+func (d *Driver) findTargetPath(mountPoint string) (string, error) {
+	refs, err := d.mounter.GetMountRefs(mountPoint)
+	if err != nil {
+		return "", err
+	}
+	for _, ref := range refs {
+		if _, _, ok := util.ParseTargetPath(ref); ok {
+			return ref, nil
+		}
+	}
+	return "", nil
+}
+
+// recoverVolume reconstructs an unknown volume from its Buildah container and targetPath.
+// It returns nil when no container exists for the volume.
+func (d *Driver) recoverVolume(volumeID, targetPath string) (*image.Volume, error) {
+	containers, err := d.stager.Buildah.ListContainers(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list Buildah containers")
+	}
+	mountPoint, ok := containers[volumeID]
+	if !ok {
+		return nil, nil
+	}
+	return d.resumeVolume(volumeID, targetPath, mountPoint)
+}
+
+// discardVolume deletes the Buildah container of a volume which can't be recovered.
+// Its contents are lost because the stage-out spec was only in the pod.
+func (d *Driver) discardVolume(volumeID, targetPath string, cause error) error {
+	if err := d.stager.Buildah.Delete(context.Background(), volumeID); err != nil {
+		return errors.Wrapf(err, "can't delete Buildah container(name=%s)", volumeID)
+	}
+	podUID, _, _ := util.ParseTargetPath(targetPath)
+	message := fmt.Sprintf("volumeID=%s discarded the container because the volume can't be recovered: %s", volumeID, cause.Error())
+	zlog.Warn().Str("VolumeID", volumeID).Str("PodUID", string(podUID)).Msg(message)
+	if d.stager.Recorder != nil {
+		d.stager.Recorder.Eventf(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: podUID}}, corev1.EventTypeNormal, "StageOutFailed", message)
+	}
+	return nil
+}
+
+// resumeVolume reconstructs the volume from the pod's volume source and
+// decides the phase to resume from the state of its container and targetPath.
+func (d *Driver) resumeVolume(volumeID, targetPath, mountPoint string) (*image.Volume, error) {
+	req, err := d.rebuildPublishRequest(volumeID, targetPath)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := image.NewVolume(req, d.clock, d.defaultStageInImage)
+	if err != nil {
+		return nil, err
+	}
+	vol.ProvisionedRoot = mountPoint
+
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "can't check targetPath(=%s) is mounted", targetPath)
+	}
+	if mountPoint != "" && err == nil && !notMnt {
+		vol.Phase = image.PhasePublished
+	} else {
+		vol.Phase = image.PhaseTargetPathUnMounted
+	}
+	return vol, nil
+}
+
+// restoreDockerConfigJson fetches the volume's secret again because it isn't persisted in the volume store.
+func (d *Driver) restoreDockerConfigJson(vol *image.Volume) error {
+	req, err := d.rebuildPublishRequest(vol.VolumeID, vol.TargetPath)
+	if err != nil {
+		return err
+	}
+	dockerConfigJson, ok := req.GetSecrets()[image.DockerConfigJsonKey]
+	if !ok {
+		return errors.Errorf("secret must have key='%s'", image.DockerConfigJsonKey)
+	}
+	vol.SetDockerConfigJson(dockerConfigJson)
+	return nil
+}
+
+// ensureDockerConfigJson restores the volume's docker config json if it is missing.
+// Stage-out continues without it when it can't be restored.
+func (d *Driver) ensureDockerConfigJson(vol *image.Volume, logger zerolog.Logger) {
+	if !vol.IsDockerConfigJsonMissing() {
+		return
+	}
+	if err := d.restoreDockerConfigJson(vol); err != nil {
+		logger.Warn().Err(err).Msg("failed to restore docker config json. continue without it.")
+	}
+}
+
+// rebuildPublishRequest reconstructs NodePublishVolumeRequest from the csi volume source
+// in the pod which owns targetPath.
+func (d *Driver) rebuildPublishRequest(volumeID, targetPath string) (*csi.NodePublishVolumeRequest, error) {
+	podUID, volumeName, ok := util.ParseTargetPath(targetPath)
+	if !ok {
+		return nil, errors.Errorf("targetPath=%s is not kubelet's csi volume path", targetPath)
+	}
+
+	pod, err := d.getPod(podUID)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := csiVolumeSource(pod, volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeContext := map[string]string{}
+	for k, v := range source.VolumeAttributes {
+		volumeContext[k] = v
+	}
+	volumeContext[util.PodInfoNamespaceKey] = pod.Namespace
+	volumeContext[util.PodInfoNameKey] = pod.Name
+	volumeContext[util.PodInfoUIDKey] = string(pod.UID)
+	volumeContext[util.PodInfoServiceAccountNameKey] = pod.Spec.ServiceAccountName
+
+	var secrets map[string]string
+	if source.NodePublishSecretRef != nil {
+		secret, err := d.kubeClient.CoreV1().Secrets(pod.Namespace).Get(source.NodePublishSecretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't get secret(namespace=%s, name=%s)", pod.Namespace, source.NodePublishSecretRef.Name)
+		}
+		secrets = map[string]string{}
+		for k, v := range secret.Data {
+			secrets[k] = string(v)
+		}
+	}
+
+	readOnly := false
+	if source.ReadOnly != nil {
+		readOnly = *source.ReadOnly
+	}
+
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:      volumeID,
+		TargetPath:    targetPath,
+		Readonly:      readOnly,
+		VolumeContext: volumeContext,
+		Secrets:       secrets,
+	}, nil
+}
+
+// getPod finds the pod of podUID running on this node.
+func csiVolumeSource(pod *corev1.Pod, volumeName string) (*corev1.CSIVolumeSource, error) {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == volumeName && v.CSI != nil && v.CSI.Driver == DriverName {
+			return v.CSI, nil
+		}
+	}
+	return nil, errors.Errorf("pod(uid=%s) doesn't have csi volume(name=%s, driver=%s)", pod.UID, volumeName, DriverName)
+}
+
+// errNoKubeClient is returned by getPod when the driver runs without kubernetes API.
+var errNoKubeClient = errors.New("kubernetes client is required to look up pods")
+
+// podNotFoundError is returned by getPod when the pod is gone.
+type podNotFoundError struct {
+	podUID types.UID
+	nodeID string
+}
+
+func (e *podNotFoundError) Error() string {
+	return fmt.Sprintf("pod(uid=%s) not found on node=%s", e.podUID, e.nodeID)
+}
+
+// isUnrecoverable reports whether the volume can never be rebuilt from its pod.
+func isUnrecoverable(err error) bool {
+	cause := errors.Cause(err)
+	if cause == errNoKubeClient {
+		return true
+	}
+	_, ok := cause.(*podNotFoundError)
+	return ok
+}
+
+func (d *Driver) getPod(podUID types.UID) (*corev1.Pod, error) {
+	if d.kubeClient == nil {
+		return nil, errNoKubeClient
+	}
+	pods, err := d.kubeClient.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", d.nodeID).String(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't list pods on node=%s", d.nodeID)
+	}
+	for i := range pods.Items {
+		if pods.Items[i].UID == podUID {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, &podNotFoundError{podUID: podUID, nodeID: d.nodeID}
+}
@@ -0,0 +1,149 @@
+package imagedriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/mount"
+)
+
+var _ = Describe("Volume reconciliation", func() {
+	var volumeID string
+	var podUID types.UID
+	var workDir string
+	var targetPath string
+	var backend *fake.Backend
+	var mounter *mount.FakeMounter
+	var driver *Driver
+
+	BeforeEach(func() {
+		volumeID = "csi-" + uuid.New().String()
+		podUID = types.UID(uuid.New().String())
+		workDir = newTestWorkDir()
+		targetPath = filepath.Join(workDir, "pods", string(podUID), "volumes", "kubernetes.io~csi", "data", "mount")
+		Expect(os.MkdirAll(targetPath, 0777)).NotTo(HaveOccurred())
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: podUID},
+			Spec: corev1.PodSpec{
+				NodeName:           testNodeID,
+				ServiceAccountName: "test-sa",
+				Volumes: []corev1.Volume{{
+					Name: "data",
+					VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{
+						Driver: DriverName,
+						VolumeAttributes: map[string]string{
+							api.StageOutImageRepoKey:    "registry:5000/test/test",
+							api.StageOutTagGeneratorKey: "podName",
+						},
+						NodePublishSecretRef: &corev1.LocalObjectReference{Name: "dockercred"},
+					}},
+				}},
+			},
+		}
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "dockercred"},
+			Data:       map[string][]byte{image.DockerConfigJsonKey: []byte("{}")},
+		}
+
+		backend = fake.NewBackend(filepath.Join(workDir, "containers"))
+		mounter = mount.NewFakeMounter(nil)
+		driver = newTestDriver(backend, mounter, kubefake.NewSimpleClientset(pod, secret))
+
+		// the state left by the driver before restart
+		Expect(backend.From(context.Background(), volumeID, "busybox:latest", "", true, buildah.RetryPolicy{})).NotTo(HaveOccurred())
+		mountPoint, err := backend.Mount(context.Background(), volumeID)
+		Expect(err).NotTo(HaveOccurred())
+		mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "overlay-" + volumeID, Path: mountPoint})
+		Expect(mounter.Mount(mountPoint, targetPath, "", []string{"bind"})).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should resume published volumes and stage them out on unpublish", func() {
+		Expect(driver.reconcileVolumes()).NotTo(HaveOccurred())
+
+		vol, err := driver.getVolume(volumeID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vol).NotTo(BeNil())
+		Expect(vol.Phase).Should(Equal(image.PhasePublished))
+		Expect(vol.TargetPath).Should(Equal(targetPath))
+		Expect(vol.PodInfo.Name).Should(Equal("test-name"))
+		Expect(vol.PodInfo.ServiceAccountName).Should(Equal("test-sa"))
+		Expect(vol.DockerConfigJson).Should(Equal("{}"))
+		Expect(vol.Spec.StageOutSpec.ImageRepository).Should(Equal("registry:5000/test/test"))
+
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+		Expect(backend.Container(volumeID)).To(BeNil())
+		Expect(driver.getVolume(volumeID)).To(BeNil())
+	})
+
+	It("should recover a volume whose targetPath was unmounted before restart", func() {
+		Expect(mounter.Unmount(targetPath)).NotTo(HaveOccurred())
+		Expect(driver.reconcileVolumes()).NotTo(HaveOccurred())
+		Expect(driver.getVolume(volumeID)).To(BeNil())
+
+		_, err := driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+		Expect(backend.Container(volumeID)).To(BeNil())
+	})
+
+	It("should fail unpublishing while the volume can't be recovered", func() {
+		Expect(mounter.Unmount(targetPath)).NotTo(HaveOccurred())
+		backend.SetError("ListContainers", errors.New("buildah failure"))
+		req := &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath}
+
+		_, err := driver.NodeUnpublishVolume(context.Background(), req)
+		Expect(status.Code(err)).Should(Equal(codes.Unavailable))
+		Expect(backend.Container(volumeID)).NotTo(BeNil())
+
+		backend.SetError("ListContainers", nil)
+		_, err = driver.NodeUnpublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+	})
+
+	It("should discard the container when its pod is gone before the volume is recovered", func() {
+		Expect(mounter.Unmount(targetPath)).NotTo(HaveOccurred())
+		Expect(driver.kubeClient.CoreV1().Pods("test-ns").Delete("test-name", &metav1.DeleteOptions{})).NotTo(HaveOccurred())
+		recorder := record.NewFakeRecorder(100)
+		driver.stager.Recorder = recorder
+
+		_, err := driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.Container(volumeID)).To(BeNil())
+		Expect(backend.Pushed()).Should(BeEmpty())
+		Eventually(recorder.Events).Should(Receive(And(ContainSubstring("StageOutFailed"), ContainSubstring("not found"))))
+	})
+})
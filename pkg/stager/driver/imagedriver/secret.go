@@ -0,0 +1,40 @@
+package imagedriver
+
+import (
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ image.PublishSecretResolver = &Driver{}
+
+// PublishSecretName returns NodePublishSecretRef of the volume in its pod.
+func (d *Driver) PublishSecretName(vol *image.Volume) (string, error) {
+	pod, err := d.getPod(vol.PodInfo.UID)
+	if err != nil {
+		return "", err
+	}
+	source, err := csiVolumeSource(pod, vol.VolumeName())
+	if err != nil {
+		return "", err
+	}
+	if source.NodePublishSecretRef == nil {
+		return "", nil
+	}
+	return source.NodePublishSecretRef.Name, nil
+}
+
+func (d *Driver) DockerConfigJson(namespace, name string) (string, error) {
+	if d.kubeClient == nil {
+		return "", errors.New("kubernetes client is required to read secrets")
+	}
+	secret, err := d.kubeClient.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "can't get secret(namespace=%s, name=%s)", namespace, name)
+	}
+	dockerConfigJson, ok := secret.Data[image.DockerConfigJsonKey]
+	if !ok {
+		return "", errors.Errorf("secret(namespace=%s, name=%s) must have key='%s'", namespace, name, image.DockerConfigJsonKey)
+	}
+	return string(dockerConfigJson), nil
+}
@@ -0,0 +1,180 @@
+package imagedriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+var _ = Describe("Push-failure spool", func() {
+	var workDir string
+	var backend *fake.Backend
+	var recorder *record.FakeRecorder
+	var driver *Driver
+	var spool *image.Spool
+
+	publish := func(failurePolicy string) *csi.NodePublishVolumeRequest {
+		req := newTestRequest(workDir, nil, map[string]string{
+			api.StageOutFailurePolicyKey:    failurePolicy,
+			api.StageOutRetryMaxAttemptsKey: "1",
+		})
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		return req
+	}
+
+	unpublish := func(req *csi.NodePublishVolumeRequest) error {
+		_, err := driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		return err
+	}
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+		driver, backend = newTestDriverIn(workDir, kubefake.NewSimpleClientset())
+		recorder = record.NewFakeRecorder(100)
+		driver.stager.Recorder = recorder
+		var err error
+		spool, err = image.NewSpool(filepath.Join(workDir, "spool"))
+		Expect(err).NotTo(HaveOccurred())
+		driver.stager.Spool = spool
+		backend.SetError("Push", &buildah.Error{Class: buildah.ErrorClassNetwork})
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should spool the image and push it later", func() {
+		req := publish(api.StageOutFailurePolicySpool)
+		Expect(unpublish(req)).NotTo(HaveOccurred())
+		Expect(driver.getVolume(req.VolumeId)).To(BeNil())
+		Expect(backend.Container(req.VolumeId)).To(BeNil())
+		Expect(backend.Images()).Should(BeEmpty())
+
+		archive := spool.ArchivePath(req.VolumeId)
+		Expect(archive).Should(BeAnExistingFile())
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("StageOutSpooled")))
+
+		By("keeping the spooled image while push keeps failing")
+		backend.SetError("PushArchive", &buildah.Error{Class: buildah.ErrorClassNetwork})
+		driver.stager.PushSpooledImages(context.Background())
+		spooled, err := spool.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spooled).Should(HaveLen(1))
+		Expect(spooled[0].Image).Should(Equal("registry:5000/test/test:test-name"))
+		Expect(spooled[0].Attempts).Should(Equal(1))
+
+		By("pushing the spooled image")
+		backend.SetError("PushArchive", nil)
+		driver.stager.PushSpooledImages(context.Background())
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("pushedImage=registry:5000/test/test@" + fake.Digest("registry:5000/test/test:test-name"))))
+		Expect(spool.List()).Should(BeEmpty())
+		Expect(archive).ShouldNot(BeAnExistingFile())
+	})
+
+	It("should read the secret again to push spooled images after restart", func() {
+		podUID := uuid.New().String()
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: types.UID(podUID)},
+			Spec: corev1.PodSpec{
+				NodeName: testNodeID,
+				Volumes: []corev1.Volume{{
+					Name: "data",
+					VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{
+						Driver:               DriverName,
+						NodePublishSecretRef: &corev1.LocalObjectReference{Name: "regcred"},
+					}},
+				}},
+			},
+		}
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "regcred"},
+			Data:       map[string][]byte{image.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+		}
+		driver.kubeClient = kubefake.NewSimpleClientset(pod, secret)
+
+		req := newTestRequest(workDir, pod, map[string]string{
+			api.StageOutFailurePolicyKey:    api.StageOutFailurePolicySpool,
+			api.StageOutRetryMaxAttemptsKey: "1",
+		})
+		req.Secrets = map[string]string{image.DockerConfigJsonKey: `{"auths":{}}`}
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unpublish(req)).NotTo(HaveOccurred())
+
+		By("restarting the driver")
+		restarted, err := image.NewSpool(spool.Dir)
+		Expect(err).NotTo(HaveOccurred())
+		driver.stager.Spool = restarted
+		spooled, err := restarted.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spooled).Should(HaveLen(1))
+		Expect(spooled[0].SecretName).Should(Equal("regcred"))
+		Expect(spooled[0].DockerConfigJson).Should(BeEmpty())
+
+		driver.stager.PushSpooledImages(context.Background())
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+		Expect(backend.PushCredential("registry:5000/test/test:test-name")).Should(Equal(`{"auths":{}}`))
+	})
+
+	It("should give up spooled images after max attempts and keep their archives", func() {
+		spool.MaxAttempts = 2
+		req := publish(api.StageOutFailurePolicySpool)
+		Expect(unpublish(req)).NotTo(HaveOccurred())
+		archive := spool.ArchivePath(req.VolumeId)
+
+		backend.SetError("PushArchive", &buildah.Error{Class: buildah.ErrorClassNetwork})
+		driver.stager.PushSpooledImages(context.Background())
+		Expect(spool.List()).Should(HaveLen(1))
+		driver.stager.PushSpooledImages(context.Background())
+		Expect(spool.List()).Should(BeEmpty())
+		Expect(archive).Should(BeAnExistingFile())
+		Eventually(recorder.Events).Should(Receive(And(ContainSubstring("StageOutFailed"), ContainSubstring("archive="+archive))))
+
+		backend.SetError("PushArchive", nil)
+		driver.stager.PushSpooledImages(context.Background())
+		Expect(backend.Pushed()).Should(BeEmpty())
+	})
+
+	It("should spool the image when pushing it on completion fails", func() {
+		req := publish(api.StageOutFailurePolicySpool)
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(driver.stager.StageOutPublished(context.Background(), vol)).NotTo(HaveOccurred())
+		Expect(vol.StagedOut).Should(BeTrue())
+		Expect(spool.List()).Should(HaveLen(1))
+
+		Expect(unpublish(req)).NotTo(HaveOccurred())
+		Expect(backend.Commits("registry:5000/test/test:test-name")).Should(Equal(1))
+		Expect(backend.Container(req.VolumeId)).To(BeNil())
+	})
+
+	It("should keep failing to unpublish by default", func() {
+		req := publish(api.StageOutFailurePolicyFail)
+		Expect(unpublish(req)).To(HaveOccurred())
+		Expect(driver.getVolume(req.VolumeId)).NotTo(BeNil())
+		Expect(spool.List()).Should(BeEmpty())
+
+		backend.SetError("Push", nil)
+		Expect(unpublish(req)).NotTo(HaveOccurred())
+		Expect(backend.Pushed()).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+	})
+})
@@ -0,0 +1,156 @@
+package imagedriver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// errVolumeBusy is returned when the volume is locked by another operation.
+var errVolumeBusy = errors.New("another operation for the volume is in progress")
+
+// stageOutQueue performs stage-out of volumes (keyed by volume ID) in background with retries.
+type stageOutQueue struct {
+	queue      workqueue.RateLimitingInterface
+	maxRetries int
+	// process stages out the volume.
+	process func(volumeID string) error
+	// abandon is called when process keeps failing more than maxRetries.
+	abandon func(volumeID string, err error)
+}
+
+func newStageOutQueue(
+	maxRetries int, baseDelay, maxDelay time.Duration,
+	process func(string) error, abandon func(string, error),
+) *stageOutQueue {
+	return &stageOutQueue{
+		queue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+			"stage-out",
+		),
+		maxRetries: maxRetries,
+		process:    process,
+		abandon:    abandon,
+	}
+}
+
+func (q *stageOutQueue) Add(volumeID string) {
+	q.queue.Add(volumeID)
+}
+
+// Run starts workers and blocks until ShutDown is called and queued volumes are drained.
+func (q *stageOutQueue) Run(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	zlog.Info().Int("workers", workers).Msg("starting stage-out workers")
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q.processNextItem() {
+			}
+		}()
+	}
+	wg.Wait()
+	zlog.Info().Msg("stopped stage-out workers")
+}
+
+func (q *stageOutQueue) ShutDown() {
+	q.queue.ShutDown()
+}
+
+func (q *stageOutQueue) processNextItem() bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+
+	volumeID := item.(string)
+	logger := zlog.With().Str("Operation", "StageOutWorker").Str("VolumeID", volumeID).Logger()
+
+	err := q.process(volumeID)
+	switch {
+	case err == nil:
+		q.queue.Forget(item)
+	case err == errVolumeBusy:
+		logger.Debug().Msg("volume is busy. retry later")
+		q.queue.AddAfter(item, time.Second)
+	case q.queue.NumRequeues(item) < q.maxRetries:
+		logger.Error().Err(err).Int("retries", q.queue.NumRequeues(item)).Msg("failed to stage-out. retry later")
+		q.queue.AddRateLimited(item)
+	default:
+		logger.Error().Err(err).Int("retries", q.queue.NumRequeues(item)).Msg("failed to stage-out. give up")
+		q.queue.Forget(item)
+		q.abandon(volumeID, err)
+	}
+	return true
+}
+
+// processStageOut performs the rest of stage-out of the volume whose targetPath has been unmounted.
+func (d *Driver) processStageOut(volumeID string) error {
+	if !d.volumeLocks.TryAcquire(volumeID) {
+		return errVolumeBusy
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	vol, err := d.getVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	if vol == nil {
+		return nil
+	}
+
+	logger := d.LogWithVolume(zlog.With().Str("Operation", "StageOutWorker").Logger(), vol)
+	logger.Debug().Msg("start")
+
+	d.ensureDockerConfigJson(vol, logger)
+
+	if err := d.stager.StageOut(context.Background(), vol); err != nil {
+		return err
+	}
+	if err := d.deleteVolume(volumeID); err != nil {
+		return err
+	}
+
+	logger.Debug().Str("PushedImage", vol.PushedImage()).Msg("succeeded")
+	return nil
+}
+
+// abandonStageOut keeps the volume (and its container) as is so that stage-out is retried after the driver restarts.
+func (d *Driver) abandonStageOut(volumeID string, err error) {
+	// the in-flight operation reports its own result.
+	if !d.volumeLocks.TryAcquire(volumeID) {
+		zlog.Debug().Str("VolumeID", volumeID).Msg("volume is busy. skip reporting the abandoned stage-out")
+		return
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	vol, errGet := d.getVolume(volumeID)
+	if errGet != nil || vol == nil {
+		return
+	}
+	d.stager.PublishEventIfSupported(vol, "StageOutFailed", fmt.Sprintf("volumeID=%s gave up stage-out: error=%s", volumeID, err.Error()))
+}
+
+// enqueueUnpublishingVolumes enqueues volumes which were being unpublished before the driver restarted.
+func (d *Driver) enqueueUnpublishingVolumes() error {
+	volumes, err := d.volumes.List()
+	if err != nil {
+		return err
+	}
+	for _, vol := range volumes {
+		if !vol.IsPublishing() {
+			d.stageOutQueue.Add(vol.VolumeID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package imagedriver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+var _ = Describe("Asynchronous stage-out", func() {
+	var workDir string
+	var backend *fake.Backend
+	var recorder *record.FakeRecorder
+	var driver *Driver
+	var req *csi.NodePublishVolumeRequest
+
+	startDriver := func(maxRetries int) {
+		driver.stageOutQueue = newStageOutQueue(maxRetries, time.Millisecond, 10*time.Millisecond, driver.processStageOut, driver.abandonStageOut)
+		go driver.stageOutQueue.Run(1)
+	}
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+		driver, backend = newTestDriverIn(workDir, nil)
+		recorder = record.NewFakeRecorder(100)
+		driver.stager.Recorder = recorder
+		req = newTestRequest(workDir, nil, nil)
+	})
+
+	AfterEach(func() {
+		driver.stageOutQueue.ShutDown()
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	unpublish := func() {
+		_, err := driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should return after unmounting targetPath and stage-out in background", func() {
+		startDriver(1000)
+		backend.SetError("Push", errors.New("registry is down"))
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		unpublish()
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vol).NotTo(BeNil())
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("StageOutQueued")))
+
+		// retried until push succeeds
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("StageOutFailed")))
+		backend.SetError("Push", nil)
+		Eventually(backend.Pushed).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+		Eventually(func() (*image.Volume, error) { return driver.getVolume(req.VolumeId) }).Should(BeNil())
+		Expect(backend.Container(req.VolumeId)).To(BeNil())
+	})
+
+	It("should give up and keep the volume after max retries", func() {
+		startDriver(2)
+		backend.SetError("Commit", errors.New("commit failure"))
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		unpublish()
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("gave up stage-out")))
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vol.Phase).Should(Equal(image.PhaseTargetPathUnMounted))
+		Expect(backend.Container(req.VolumeId)).NotTo(BeNil())
+	})
+
+	It("should stage out by the pod outcome resolved before queueing", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-name", UID: types.UID(req.VolumeId)},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}},
+			}}},
+		}
+		kubeClient := kubefake.NewSimpleClientset(pod)
+		driver.kubeClient = kubeClient
+		req.VolumeContext[api.StageOutWhenKey] = api.StageOutWhenOnSuccess
+		driver.stageOutQueue = newStageOutQueue(3, time.Millisecond, 10*time.Millisecond, driver.processStageOut, driver.abandonStageOut)
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		unpublish()
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vol.PodOutcome).Should(Equal(image.PodOutcomeSucceeded))
+
+		// the pod is gone before the queued stage-out runs.
+		Expect(kubeClient.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})).NotTo(HaveOccurred())
+		go driver.stageOutQueue.Run(1)
+		Eventually(backend.Pushed).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+	})
+
+	It("should report giving up only while the volume isn't locked", func() {
+		startDriver(1)
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(driver.volumeLocks.TryAcquire(req.VolumeId)).Should(BeTrue())
+		driver.abandonStageOut(req.VolumeId, errors.New("push failure"))
+		driver.volumeLocks.Release(req.VolumeId)
+		Consistently(recorder.Events, 50*time.Millisecond).ShouldNot(Receive(ContainSubstring("gave up stage-out")))
+
+		driver.abandonStageOut(req.VolumeId, errors.New("push failure"))
+		Eventually(recorder.Events).Should(Receive(ContainSubstring("gave up stage-out")))
+	})
+
+	It("should enqueue volumes which were being unpublished before restart", func() {
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		vol, err := driver.getVolume(req.VolumeId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(driver.stager.UnmountTargetPath(vol)).NotTo(HaveOccurred())
+
+		startDriver(3)
+		Expect(driver.enqueueUnpublishingVolumes()).NotTo(HaveOccurred())
+		Eventually(backend.Pushed).Should(Equal([]string{"registry:5000/test/test:test-name"}))
+	})
+})
@@ -0,0 +1,94 @@
+package imagedriver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/everpeace/csi-driver-stager/pkg/stager/api/v1alpha1"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+var _ image.StageHistory = &Driver{}
+
+// maxRecordNamePrefixLength leaves room for "-stageout-xxxxx" in 253 characters.
+const maxRecordNamePrefixLength = 238
+
+// RecordStage creates a StageRecord in the pod's namespace.
+func (d *Driver) RecordStage(result image.StageResult) error {
+	if d.dynamicClient == nil {
+		return nil
+	}
+	record := d.newStageRecord(result)
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(record)
+	if err != nil {
+		return errors.Wrap(err, "can't convert StageRecord")
+	}
+	_, err = d.dynamicClient.Resource(v1alpha1.StageRecordsResource).Namespace(record.Namespace).Create(&unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "can't create StageRecord(%s/%s)", record.Namespace, record.Name)
+	}
+	return nil
+}
+
+func (d *Driver) newStageRecord(result image.StageResult) *v1alpha1.StageRecord {
+	prefix := result.Pod.Name
+	if len(prefix) > maxRecordNamePrefixLength {
+		prefix = prefix[:maxRecordNamePrefixLength]
+	}
+	stage := strings.ToLower(string(result.Stage))
+
+	spec := v1alpha1.StageRecordSpec{
+		Stage:      string(result.Stage),
+		Pod:        v1alpha1.PodReference{Name: result.Pod.Name, UID: result.Pod.UID},
+		NodeName:   d.nodeID,
+		VolumeID:   result.VolumeID,
+		VolumeName: result.VolumeName,
+		Error:      result.Error,
+	}
+	switch result.Stage {
+	case image.StageIn:
+		spec.Image = result.StageInImage
+		spec.Digest = result.StageInDigest
+		spec.Result = "Succeeded"
+		if result.Error != "" {
+			spec.Result = "Failed"
+		}
+	case image.StageOut:
+		spec.Image = result.StageOutImage
+		spec.Digest = result.StageOutDigest
+		spec.Result = string(result.StageOutStatus)
+		for _, d := range result.Destinations {
+			spec.Destinations = append(spec.Destinations, v1alpha1.Destination{
+				Image:    d.Image,
+				Required: d.Required,
+				Pushed:   d.Pushed,
+				Digest:   d.Digest,
+				Error:    d.Error,
+			})
+		}
+	}
+	for _, p := range result.Phases {
+		spec.Phases = append(spec.Phases, v1alpha1.PhaseTiming{Phase: string(p.Phase), Time: metav1.NewTime(p.Time)})
+	}
+
+	return &v1alpha1.StageRecord{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Kind:       v1alpha1.StageRecordKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: result.Pod.Namespace,
+			Name:      fmt.Sprintf("%s-%s-%s", prefix, stage, utilrand.String(5)),
+			Labels: map[string]string{
+				v1alpha1.StageRecordPodUIDLabel: string(result.Pod.UID),
+				v1alpha1.StageRecordStageLabel:  stage,
+			},
+		},
+		Spec: spec,
+	}
+}
@@ -0,0 +1,103 @@
+package imagedriver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/api/v1alpha1"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+var _ = Describe("StageRecord", func() {
+	var workDir string
+	var backend *fake.Backend
+	var dynamicClient *dynamicfake.FakeDynamicClient
+	var driver *Driver
+
+	listRecords := func() []v1alpha1.StageRecord {
+		list, err := dynamicClient.Resource(v1alpha1.StageRecordsResource).Namespace("test-ns").List(metav1.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		records := []v1alpha1.StageRecord{}
+		for _, item := range list.Items {
+			record := v1alpha1.StageRecord{}
+			Expect(runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &record)).NotTo(HaveOccurred())
+			records = append(records, record)
+		}
+		// StageIn < StageOut
+		sort.Slice(records, func(i, j int) bool { return records[i].Spec.Stage < records[j].Spec.Stage })
+		return records
+	}
+
+	BeforeEach(func() {
+		workDir = newTestWorkDir()
+		driver, backend = newTestDriverIn(workDir, kubefake.NewSimpleClientset())
+		dynamicClient = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+		driver.dynamicClient = dynamicClient
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should record stage-in and stage-out", func() {
+		req := newTestRequest(workDir, nil, nil)
+		podUID := req.VolumeContext[util.PodInfoUIDKey]
+		_, err := driver.NodePublishVolume(context.Background(), req)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = driver.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   req.VolumeId,
+			TargetPath: req.TargetPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		records := listRecords()
+		Expect(records).Should(HaveLen(2))
+
+		stageIn := records[0]
+		Expect(stageIn.Labels).Should(HaveKeyWithValue(v1alpha1.StageRecordPodUIDLabel, podUID))
+		Expect(stageIn.Labels).Should(HaveKeyWithValue(v1alpha1.StageRecordStageLabel, "stagein"))
+		Expect(stageIn.Spec.Stage).Should(Equal(string(image.StageIn)))
+		Expect(stageIn.Spec.Pod.Name).Should(Equal("test-name"))
+		Expect(string(stageIn.Spec.Pod.UID)).Should(Equal(podUID))
+		Expect(stageIn.Spec.NodeName).Should(Equal(testNodeID))
+		Expect(stageIn.Spec.VolumeID).Should(Equal(req.VolumeId))
+		Expect(stageIn.Spec.VolumeName).Should(Equal("data"))
+		Expect(stageIn.Spec.Image).Should(Equal("busybox:latest"))
+		Expect(stageIn.Spec.Digest).Should(Equal(fake.Digest("busybox:latest")))
+		Expect(stageIn.Spec.Result).Should(Equal("Succeeded"))
+		Expect(stageIn.Spec.Error).Should(BeEmpty())
+		Expect(stageIn.Spec.Phases).ShouldNot(BeEmpty())
+		Expect(stageIn.Spec.Phases[len(stageIn.Spec.Phases)-1].Phase).Should(Equal(string(image.PhasePublished)))
+
+		stageOut := records[1]
+		Expect(stageOut.Labels).Should(HaveKeyWithValue(v1alpha1.StageRecordStageLabel, "stageout"))
+		Expect(stageOut.Spec.Image).Should(Equal("registry:5000/test/test:test-name"))
+		Expect(stageOut.Spec.Digest).Should(Equal(fake.Digest("registry:5000/test/test:test-name")))
+		Expect(stageOut.Spec.Result).Should(Equal(string(api.StageOutStatusSucceeded)))
+		Expect(stageOut.Spec.Phases[0].Phase).Should(Equal(string(image.PhasePublished)))
+	})
+
+	It("should record failed stage-in", func() {
+		backend.SetError("From", errors.New("pull failed"))
+		_, err := driver.NodePublishVolume(context.Background(), newTestRequest(workDir, nil, nil))
+		Expect(err).To(HaveOccurred())
+
+		records := listRecords()
+		Expect(records).Should(HaveLen(1))
+		Expect(records[0].Spec.Stage).Should(Equal(string(image.StageIn)))
+		Expect(records[0].Spec.Result).Should(Equal("Failed"))
+		Expect(records[0].Spec.Error).Should(ContainSubstring("pull failed"))
+	})
+})
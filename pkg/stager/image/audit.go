@@ -0,0 +1,199 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// AuditOperation is the operation recorded in the audit log.
+type AuditOperation string
+
+const (
+	AuditOperationStageIn    AuditOperation = "StageIn"
+	AuditOperationStageOut   AuditOperation = "StageOut"
+	AuditOperationCheckpoint AuditOperation = "Checkpoint"
+)
+
+// AuditEntry is a line of the audit log. It must never contain credentials.
+type AuditEntry struct {
+	Time           time.Time      `json:"time"`
+	Operation      AuditOperation `json:"operation"`
+	Pod            AuditPod       `json:"pod"`
+	ServiceAccount string         `json:"serviceAccount"`
+	VolumeID       string         `json:"volumeID"`
+	VolumeName     string         `json:"volumeName,omitempty"`
+	Image          string         `json:"image"`
+	Digest         string         `json:"digest,omitempty"`
+	// Outcome is "Succeeded" or "Failed" for stage-in and checkpoints, and api.StageOutStatus for stage-out.
+	Outcome         string  `json:"outcome"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+	// Destinations are set when stage-out pushes the image to more than one reference.
+	Destinations []Destination `json:"destinations,omitempty"`
+}
+
+type AuditPod struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid"`
+}
+
+// AuditLog writes AuditEntry as JSON lines to Path.
+// Path is rotated to Path.1, Path.2, ... when it exceeds MaxSize bytes, and at most MaxBackups rotated files are kept.
+type AuditLog struct {
+	Path string
+	// MaxSize disables rotation when it is zero.
+	MaxSize    int64
+	MaxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func NewAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrapf(err, "can't create audit log directory(=%s)", filepath.Dir(path))
+	}
+	l := &AuditLog{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "can't open audit log(=%s)", l.Path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "can't stat audit log(=%s)", l.Path)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends the entry. It does nothing when l is nil.
+func (l *AuditLog) Write(entry AuditEntry) error {
+	if l == nil {
+		return nil
+	}
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrapf(err, "can't marshal audit entry(volumeID=%s)", entry.VolumeID)
+	}
+	bytes = append(bytes, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return errors.Errorf("audit log(=%s) is closed", l.Path)
+	}
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(bytes)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(bytes)
+	l.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "can't write audit log(=%s)", l.Path)
+	}
+	return nil
+}
+
+func (l *AuditLog) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.Path, n)
+}
+
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return errors.Wrapf(err, "can't close audit log(=%s)", l.Path)
+	}
+	l.file = nil
+	if l.MaxBackups <= 0 {
+		if err := os.Remove(l.Path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "can't remove audit log(=%s)", l.Path)
+		}
+		return l.open()
+	}
+	if err := os.Remove(l.backupPath(l.MaxBackups)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can't remove audit log(=%s)", l.backupPath(l.MaxBackups))
+	}
+	for n := l.MaxBackups - 1; n >= 1; n-- {
+		if err := os.Rename(l.backupPath(n), l.backupPath(n+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "can't rotate audit log(=%s)", l.backupPath(n))
+		}
+	}
+	if err := os.Rename(l.Path, l.backupPath(1)); err != nil {
+		return errors.Wrapf(err, "can't rotate audit log(=%s)", l.Path)
+	}
+	return l.open()
+}
+
+// Close closes the log file. Entries written after Close are dropped with errors.
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// audit never fails staging volumes like report.
+func (stager *Stager) audit(entry AuditEntry) {
+	if err := stager.AuditLog.Write(entry); err != nil {
+		zlog.Warn().Err(err).Interface("Entry", entry).Msg("failed to write audit log")
+	}
+}
+
+func (result StageResult) auditEntry() AuditEntry {
+	entry := AuditEntry{
+		Time: result.Time,
+		Pod: AuditPod{
+			Namespace: result.Pod.Namespace,
+			Name:      result.Pod.Name,
+			UID:       result.Pod.UID,
+		},
+		ServiceAccount:  result.ServiceAccount,
+		VolumeID:        result.VolumeID,
+		VolumeName:      result.VolumeName,
+		DurationSeconds: result.Duration.Seconds(),
+		Error:           result.Error,
+	}
+	switch result.Stage {
+	case StageIn:
+		entry.Operation = AuditOperationStageIn
+		entry.Image = result.StageInImage
+		entry.Digest = result.StageInDigest
+		entry.Outcome = "Succeeded"
+		if result.Error != "" {
+			entry.Outcome = "Failed"
+		}
+	case StageOut:
+		entry.Operation = AuditOperationStageOut
+		entry.Image = result.StageOutImage
+		entry.Digest = result.StageOutDigest
+		entry.Outcome = string(result.StageOutStatus)
+		entry.Destinations = result.Destinations
+	}
+	return entry
+}
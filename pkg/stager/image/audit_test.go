@@ -0,0 +1,203 @@
+package image_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"k8s.io/utils/mount"
+)
+
+func readAuditLog(path string) []image.AuditEntry {
+	file, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer file.Close()
+	entries := []image.AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := image.AuditEntry{}
+		Expect(json.Unmarshal(scanner.Bytes(), &entry)).NotTo(HaveOccurred())
+		entries = append(entries, entry)
+	}
+	Expect(scanner.Err()).NotTo(HaveOccurred())
+	return entries
+}
+
+var _ = Describe("AuditLog", func() {
+	var workDir string
+	var path string
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = ioutil.TempDir("", "audit-log-test-")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(workDir, "audit", "audit.log")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should append entries as JSON lines", func() {
+		auditLog, err := image.NewAuditLog(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(auditLog.Write(image.AuditEntry{VolumeID: "vol-1", Outcome: "Succeeded"})).NotTo(HaveOccurred())
+		Expect(auditLog.Close()).NotTo(HaveOccurred())
+
+		// entries are appended to the existing log
+		auditLog, err = image.NewAuditLog(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(auditLog.Write(image.AuditEntry{VolumeID: "vol-2", Outcome: "Failed"})).NotTo(HaveOccurred())
+		Expect(auditLog.Close()).NotTo(HaveOccurred())
+
+		entries := readAuditLog(path)
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].VolumeID).To(Equal("vol-1"))
+		Expect(entries[1].VolumeID).To(Equal("vol-2"))
+
+		info, err := os.Stat(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("should rotate the log", func() {
+		// each entry exceeds maxSize so that every write rotates the log.
+		auditLog, err := image.NewAuditLog(path, 10, 2)
+		Expect(err).NotTo(HaveOccurred())
+		for _, id := range []string{"vol-1", "vol-2", "vol-3", "vol-4"} {
+			Expect(auditLog.Write(image.AuditEntry{VolumeID: id})).NotTo(HaveOccurred())
+		}
+		Expect(auditLog.Close()).NotTo(HaveOccurred())
+
+		Expect(readAuditLog(path)[0].VolumeID).To(Equal("vol-4"))
+		Expect(readAuditLog(path + ".1")[0].VolumeID).To(Equal("vol-3"))
+		Expect(readAuditLog(path + ".2")[0].VolumeID).To(Equal("vol-2"))
+		Expect(path + ".3").NotTo(BeAnExistingFile())
+	})
+
+	It("should fail to write after closed", func() {
+		auditLog, err := image.NewAuditLog(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(auditLog.Close()).NotTo(HaveOccurred())
+		Expect(auditLog.Write(image.AuditEntry{VolumeID: "vol-1"})).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Stager with AuditLog", func() {
+	var volumeID string
+	var workDir string
+	var path string
+	var stager *image.Stager
+
+	BeforeEach(func() {
+		var err error
+		volumeID = uuid.New().String()
+		workDir, err = ioutil.TempDir("", "stager-audit-test-")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(workDir, "audit.log")
+		auditLog, err := image.NewAuditLog(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		stager = &image.Stager{
+			Buildah:  fake.NewBackend(filepath.Join(workDir, "containers")),
+			Mounter:  mount.NewFakeMounter(nil),
+			AuditLog: auditLog,
+		}
+	})
+
+	AfterEach(func() {
+		Expect(stager.AuditLog.Close()).NotTo(HaveOccurred())
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should audit stage-in and stage-out without credentials", func() {
+		targetPath := filepath.Join(workDir, "pods", volumeID, "volumes", "kubernetes.io~csi", "my-volume", "mount")
+		Expect(os.MkdirAll(targetPath, 0777)).NotTo(HaveOccurred())
+		dockerConfigJson := `{"auths":{"registry:5000":{"auth":"c2VjcmV0OnNlY3JldA=="}}}`
+		vol, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+			VolumeContext: map[string]string{
+				util.PodInfoNamespaceKey:          "test-ns",
+				util.PodInfoNameKey:               "test-name",
+				util.PodInfoUIDKey:                volumeID,
+				util.PodInfoServiceAccountNameKey: "test-sa",
+				api.StageOutImageRepoKey:          "registry:5000/test/test",
+				api.StageOutTagGeneratorKey:       "podUid",
+			},
+			Secrets: map[string]string{image.DockerConfigJsonKey: dockerConfigJson},
+		}, fakeClock, "busybox:latest")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+		Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+
+		entries := readAuditLog(path)
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0]).To(Equal(image.AuditEntry{
+			Time:           fakeNow,
+			Operation:      image.AuditOperationStageIn,
+			Pod:            image.AuditPod{Namespace: "test-ns", Name: "test-name", UID: vol.PodInfo.UID},
+			ServiceAccount: "test-sa",
+			VolumeID:       volumeID,
+			VolumeName:     "my-volume",
+			Image:          "busybox:latest",
+			Digest:         fake.Digest("busybox:latest"),
+			Outcome:        "Succeeded",
+		}))
+		Expect(entries[1].Operation).To(Equal(image.AuditOperationStageOut))
+		Expect(entries[1].Image).To(Equal(vol.ImageToPush))
+		Expect(entries[1].Digest).To(Equal(vol.PushedDigest))
+		Expect(entries[1].Outcome).To(Equal(string(api.StageOutStatusSucceeded)))
+
+		bytes, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bytes)).NotTo(ContainSubstring("c2VjcmV0OnNlY3JldA=="))
+	})
+	It("should audit failures of mounting and committing", func() {
+		backend := stager.Buildah.(*fake.Backend)
+		targetPath := filepath.Join(workDir, "targetpath")
+		Expect(os.MkdirAll(targetPath, 0777)).NotTo(HaveOccurred())
+		vol, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+			VolumeContext: map[string]string{
+				util.PodInfoNamespaceKey:          "test-ns",
+				util.PodInfoNameKey:               "test-name",
+				util.PodInfoUIDKey:                volumeID,
+				util.PodInfoServiceAccountNameKey: "test-sa",
+				api.StageOutImageRepoKey:          "registry:5000/test/test",
+			},
+		}, fakeClock, "busybox:latest")
+		Expect(err).NotTo(HaveOccurred())
+
+		backend.SetError("Mount", errors.New("mount failure"))
+		Expect(stager.StageIn(context.Background(), vol)).To(HaveOccurred())
+		backend.SetError("Mount", nil)
+		Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+		backend.SetError("Commit", errors.New("no space left on device"))
+		Expect(stager.StageOut(context.Background(), vol)).To(HaveOccurred())
+
+		entries := readAuditLog(path)
+		Expect(entries).To(HaveLen(3))
+		Expect(entries[0].Operation).To(Equal(image.AuditOperationStageIn))
+		Expect(entries[0].Outcome).To(Equal("Failed"))
+		Expect(entries[0].Error).To(ContainSubstring("mount failure"))
+		Expect(entries[1].Operation).To(Equal(image.AuditOperationStageIn))
+		Expect(entries[1].Outcome).To(Equal("Succeeded"))
+		Expect(entries[2].Operation).To(Equal(image.AuditOperationStageOut))
+		Expect(entries[2].Outcome).To(Equal(string(api.StageOutStatusFailed)))
+		Expect(entries[2].Error).To(ContainSubstring("no space left on device"))
+	})
+})
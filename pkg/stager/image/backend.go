@@ -0,0 +1,37 @@
+package image
+
+import (
+	"context"
+
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+)
+
+// Backend is the set of container image operations Stager relies on.
+// buildah.Client is the production implementation.
+// Operations should be aborted when ctx is done.
+type Backend interface {
+	IsContainerExist(ctx context.Context, containerName string) (bool, error)
+	ListContainers(ctx context.Context) (map[string]string, error)
+	From(ctx context.Context, containerName, image, dockerConfigJson string, tlsVerify bool, retryPolicy buildah.RetryPolicy) error
+	// FromImageDigest returns the manifest digest of the image which the container was created from.
+	FromImageDigest(ctx context.Context, containerName string) (string, error)
+	Mount(ctx context.Context, containerName string) (string, error)
+	Umount(ctx context.Context, containerName string) error
+	// IsModified returns true when the container's writable layer has any changes.
+	// It should return true when it can't tell.
+	IsModified(ctx context.Context, containerName string) (bool, error)
+	Commit(ctx context.Context, containerName, image string, options buildah.CommitOptions) error
+	// Tag adds tags (i.e. other references) to the local image.
+	Tag(ctx context.Context, image string, tags ...string) error
+	// Push returns the manifest digest of the pushed image.
+	Push(ctx context.Context, containerName, image, dockerConfigJson string, tlsVerify bool, retryPolicy buildah.RetryPolicy, options buildah.PushOptions) (string, error)
+	// Export writes the image to an OCI archive at archivePath.
+	Export(ctx context.Context, image, archivePath string) error
+	// PushArchive pushes the image in the OCI archive exported by Export. It returns the manifest digest like Push.
+	PushArchive(ctx context.Context, archivePath, image, dockerConfigJson string, tlsVerify bool, retryPolicy buildah.RetryPolicy, options buildah.PushOptions) (string, error)
+	Delete(ctx context.Context, containerName string) error
+	RemoveImage(ctx context.Context, image string) error
+	GarbageCollectOnce(ctx context.Context)
+}
+
+var _ Backend = &buildah.Client{}
@@ -0,0 +1,13 @@
+package buildah
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestBuildah(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Buildah Client Test Suite")
+}
@@ -2,11 +2,15 @@ package buildah
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,60 +32,75 @@ type Client struct {
 	GcTimeout  time.Duration
 }
 
-func (b *Client) runCmd(args []string) ([]byte, error) {
-	return b.runCmdWithTimeout(args, b.Timeout)
+type timeoutKey struct{}
+
+// WithTimeout returns a context which overrides Client.Timeout for buildah commands run with it.
+func WithTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, timeoutKey{}, timeout)
+}
+
+func (b *Client) runCmd(ctx context.Context, args []string) ([]byte, error) {
+	timeout := b.Timeout
+	if t, ok := ctx.Value(timeoutKey{}).(time.Duration); ok && t > 0 {
+		timeout = t
+	}
+	return b.runCmdWithTimeout(ctx, args, timeout)
 }
 
-func (b *Client) runCmdWithTimeout(args []string, runTimeout time.Duration) ([]byte, error) {
+// runCmdWithTimeout runs buildah command. The command is killed when ctx is done or runTimeout passed,
+// whichever comes first.
+func (b *Client) runCmdWithTimeout(ctx context.Context, args []string, runTimeout time.Duration) ([]byte, error) {
 	execPath := b.ExecPath
-	actualArgs := append(b.Args, args...)
+	actualArgs := append(append([]string{}, b.Args...), args...)
 
-	cmd := exec.Command(execPath, actualArgs...)
+	if runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, runTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, execPath, actualArgs...)
 
 	var buf bytes.Buffer
 	cmd.Stdout = &buf
 	cmd.Stderr = &buf
 
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
-	done := make(chan error)
-	go func() {
-		done <- cmd.Wait()
-	}()
-
-	// Start a timer
-	timeout := make(<-chan time.Time)
-	if runTimeout > 0 {
-		timeout = time.After(b.Timeout)
-	}
-
-	select {
-	case <-timeout:
-		// Timeout happened first, kill the process and print a message.
-		_ = cmd.Process.Kill()
-		return buf.Bytes(), errors.Errorf("command timeout after %v", runTimeout)
-	case err := <-done:
-		output := buf.Bytes()
-		if err != nil {
-			zlog.Error().
-				Str("exec", execPath).
-				Strs("args", actualArgs).
-				Err(err).
-				Bytes("output", output).
-				Msg("command failed")
-			return output, errors.Wrapf(err, "command %s failed: %s", cmd.String(), output)
+	err := cmd.Run()
+	output := buf.Bytes()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return output, &Error{
+			Class:   ErrorClassTimeout,
+			Output:  string(output),
+			Message: fmt.Sprintf("command %s was killed because deadline exceeded (timeout=%v)", cmd.String(), runTimeout),
+		}
+	case ctx.Err() == context.Canceled:
+		return output, &Error{
+			Class:   ErrorClassCanceled,
+			Output:  string(output),
+			Message: fmt.Sprintf("command %s was killed because it was canceled", cmd.String()),
 		}
-		zlog.Debug().
+	case err != nil:
+		zlog.Error().
 			Str("exec", execPath).
 			Strs("args", actualArgs).
+			Err(err).
 			Bytes("output", output).
-			Msg("command succeeded")
-		return output, nil
+			Msg("command failed")
+		return output, &Error{
+			Class:   classifyOutput(output),
+			Output:  string(output),
+			Message: fmt.Sprintf("command %s failed: %s: %s", cmd.String(), err.Error(), output),
+		}
 	}
+	zlog.Debug().
+		Str("exec", execPath).
+		Strs("args", actualArgs).
+		Bytes("output", output).
+		Msg("command succeeded")
+	return output, nil
 }
 
-func (b *Client) IsContainerExist(containerName string) (bool, error) {
+func (b *Client) IsContainerExist(ctx context.Context, containerName string) (bool, error) {
 	args := []string{
 		"containers",
 		"--format", "{{.ContainerName}}",
@@ -89,7 +108,7 @@ func (b *Client) IsContainerExist(containerName string) (bool, error) {
 		"--filter", fmt.Sprintf("name=%s", containerName),
 	}
 
-	output, err := b.runCmd(args)
+	output, err := b.runCmd(ctx, args)
 
 	if err != nil {
 		return false, err
@@ -102,7 +121,37 @@ func (b *Client) IsContainerExist(containerName string) (bool, error) {
 	return true, nil
 }
 
-func (b *Client) From(containerName, image, dockerConfigJson string, tlsVerify bool) error {
+// ListContainers returns mount points of all containers keyed by container names.
+// The mount point is empty when the container is not mounted.
+func (b *Client) ListContainers(ctx context.Context) (map[string]string, error) {
+	args := []string{
+		"containers",
+		"--format", "{{.ContainerName}}",
+		"--noheading",
+	}
+	output, err := b.runCmd(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := map[string]string{}
+	for _, containerName := range strings.Fields(string(output)) {
+		args := []string{
+			"inspect",
+			"--type", "container",
+			"--format", "{{.MountPoint}}",
+			containerName,
+		}
+		output, err := b.runCmd(ctx, args)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't inspect container(name=%s)", containerName)
+		}
+		containers[containerName] = strings.TrimSpace(string(output))
+	}
+	return containers, nil
+}
+
+func (b *Client) From(ctx context.Context, containerName, image, dockerConfigJson string, tlsVerify bool, retryPolicy RetryPolicy) error {
 	args := []string{"from", "--name", containerName, "--pull-always"}
 	if !tlsVerify {
 		args = append(args, "--tls-verify=false")
@@ -117,16 +166,29 @@ func (b *Client) From(containerName, image, dockerConfigJson string, tlsVerify b
 	}
 	args = append(args, image)
 
-	_, err := b.runCmd(args)
-	if err != nil {
+	return retry(ctx, retryPolicy, "From", func() error {
+		_, err := b.runCmd(ctx, args)
 		return err
+	})
+}
+
+func (b *Client) FromImageDigest(ctx context.Context, containerName string) (string, error) {
+	args := []string{
+		"inspect",
+		"--type", "container",
+		"--format", "{{.FromImageDigest}}",
+		containerName,
 	}
-	return nil
+	output, err := b.runCmd(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
 }
 
-func (b *Client) Mount(containerName string) (string, error) {
+func (b *Client) Mount(ctx context.Context, containerName string) (string, error) {
 	args := []string{"mount", containerName}
-	output, err := b.runCmd(args)
+	output, err := b.runCmd(ctx, args)
 	glog.V(4).Infof("Client %s: %s", strings.Join(args, " "), string(output))
 	if err != nil {
 		return "", errors.Wrapf(err, "'Client %s' failed", strings.Join(args, " "))
@@ -136,59 +198,268 @@ func (b *Client) Mount(containerName string) (string, error) {
 	return provisionedRoot, nil
 }
 
-func (b *Client) Commit(containerName, image string, squash bool) error {
-	args := []string{"commit", "--format", "docker"}
-	if squash {
+// IsModified inspects the upper directory of the container's overlay mount.
+// Containers with other storage drivers are always regarded as modified.
+func (b *Client) IsModified(ctx context.Context, containerName string) (bool, error) {
+	args := []string{
+		"inspect",
+		"--type", "container",
+		"--format", "{{.MountPoint}}",
+		containerName,
+	}
+	output, err := b.runCmd(ctx, args)
+	if err != nil {
+		return false, err
+	}
+	mountPoint := strings.TrimSpace(string(output))
+	if mountPoint == "" || filepath.Base(mountPoint) != "merged" {
+		return true, nil
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(filepath.Dir(mountPoint), "diff"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, errors.Wrapf(err, "can't read upper directory of container(name=%s)", containerName)
+	}
+	return len(entries) > 0, nil
+}
+
+// CommitOptions configures images created by Commit.
+type CommitOptions struct {
+	// Format is "docker" (default) or "oci".
+	Format string
+	Squash bool
+	// Scratch commits only the files written to the container, which Filter selects, on an empty image.
+	Scratch bool
+	Filter  PathFilter
+	// Labels and Config are set to the container's config before committing.
+	Labels map[string]string
+	Config ImageConfig
+}
+
+// ImageConfig overrides the container's config. Empty fields are kept as they are.
+type ImageConfig struct {
+	// Entrypoint and Cmd are JSON arrays (exec form) or strings (shell form).
+	Entrypoint string
+	Cmd        string
+	Env        map[string]string
+	WorkingDir string
+	Author     string
+}
+
+func (b *Client) Commit(ctx context.Context, containerName, image string, options CommitOptions) error {
+	if options.Scratch {
+		return b.commitScratch(ctx, containerName, image, options)
+	}
+	return b.commit(ctx, containerName, image, options)
+}
+
+func (b *Client) commit(ctx context.Context, containerName, image string, options CommitOptions) error {
+	if err := b.config(ctx, containerName, options); err != nil {
+		return err
+	}
+
+	format := options.Format
+	if format == "" {
+		format = "docker"
+	}
+	args := []string{"commit", "--format", format}
+	if options.Squash {
 		args = append(args, "--squash")
 	}
 	args = append(args, containerName, image)
 
-	_, err := b.runCmd(args)
+	_, err := b.runCmd(ctx, args)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (b *Client) Umount(containerName string) error {
+// config runs "buildah config" only when options have anything to set.
+func (b *Client) config(ctx context.Context, containerName string, options CommitOptions) error {
+	args := []string{}
+	for _, key := range sortedKeys(options.Labels) {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", key, options.Labels[key]))
+	}
+	if options.Config.Entrypoint != "" {
+		args = append(args, "--entrypoint", options.Config.Entrypoint)
+	}
+	if options.Config.Cmd != "" {
+		args = append(args, "--cmd", options.Config.Cmd)
+	}
+	for _, key := range sortedKeys(options.Config.Env) {
+		args = append(args, "--env", fmt.Sprintf("%s=%s", key, options.Config.Env[key]))
+	}
+	if options.Config.WorkingDir != "" {
+		args = append(args, "--workingdir", options.Config.WorkingDir)
+	}
+	if options.Config.Author != "" {
+		args = append(args, "--author", options.Config.Author)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	_, err := b.runCmd(ctx, append(append([]string{"config"}, args...), containerName))
+	return err
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *Client) Umount(ctx context.Context, containerName string) error {
 	args := []string{"umount", containerName}
-	_, err := b.runCmd(args)
+	_, err := b.runCmd(ctx, args)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (b *Client) Push(containerName, image, dockerConfigJson string, tlsVerify bool) error {
-	args := []string{"push"}
+func (b *Client) Tag(ctx context.Context, image string, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	args := append([]string{"tag", image}, tags...)
+	_, err := b.runCmd(ctx, args)
+	return err
+}
+
+// PushOptions configures manifests and layers of pushed images. Zero values are buildah's defaults.
+// --compression-format and --compression-level require buildah v1.31 or later (see BUILADH_IMG in Makefile).
+type PushOptions struct {
+	// Format is "docker" or "oci".
+	Format string
+	// Compression is "gzip", "zstd" or "uncompressed".
+	Compression      string
+	CompressionLevel int
+}
+
+func (o PushOptions) args() []string {
+	args := []string{}
+	switch o.Format {
+	case "docker":
+		args = append(args, "--format", "v2s2")
+	case "oci":
+		args = append(args, "--format", "oci")
+	}
+	switch o.Compression {
+	case "":
+	case "uncompressed":
+		args = append(args, "--disable-compression")
+	default:
+		args = append(args, "--compression-format", o.Compression)
+	}
+	if o.CompressionLevel > 0 {
+		args = append(args, "--compression-level", strconv.Itoa(o.CompressionLevel))
+	}
+	return args
+}
+
+func (b *Client) Push(ctx context.Context, containerName, image, dockerConfigJson string, tlsVerify bool, retryPolicy RetryPolicy, options PushOptions) (string, error) {
+	args := options.args()
 	if !tlsVerify {
 		args = append(args, "--tls-verify=false")
 	}
 	if dockerConfigJson != "" {
 		authFilePath, cleanupFunc, err := b.CreateDockerAuth(containerName, dockerConfigJson)
 		if err != nil {
-			return errors.Wrapf(err, "can't create authfile=%s", authFilePath)
+			return "", errors.Wrapf(err, "can't create authfile=%s", authFilePath)
 		}
 		defer cleanupFunc()
 		args = append(args, "--authfile", authFilePath)
 	}
 	args = append(args, image)
-	_, err := b.runCmd(args)
+	return b.pushWithDigest(ctx, "Push", containerName, args, retryPolicy)
+}
+
+// pushWithDigest runs buildah push with args and returns the digest written to its --digestfile.
+func (b *Client) pushWithDigest(ctx context.Context, op, name string, args []string, retryPolicy RetryPolicy) (string, error) {
+	digestFile, err := ioutil.TempFile("", fmt.Sprintf("%s-%s-digest-", b.DriverName, name))
 	if err != nil {
+		return "", errors.Wrap(err, "can't create digest file")
+	}
+	defer func() { _ = os.Remove(digestFile.Name()) }()
+	if err := digestFile.Close(); err != nil {
+		return "", errors.Wrap(err, "can't create digest file")
+	}
+
+	args = append([]string{"push", "--digestfile", digestFile.Name()}, args...)
+	if err := retry(ctx, retryPolicy, op, func() error {
+		_, err := b.runCmd(ctx, args)
 		return err
+	}); err != nil {
+		return "", err
 	}
-	return nil
+	digest, err := ioutil.ReadFile(digestFile.Name())
+	if err != nil {
+		return "", errors.Wrapf(err, "can't read digest file(=%s)", digestFile.Name())
+	}
+	return strings.TrimSpace(string(digest)), nil
 }
 
-func (b *Client) Delete(containerName string) error {
+func (b *Client) Export(ctx context.Context, image, archivePath string) error {
+	args := []string{"push", image, fmt.Sprintf("oci-archive:%s", archivePath)}
+	_, err := b.runCmd(ctx, args)
+	return err
+}
+
+// PushArchive pulls the archive to a temporary local image, then pushes and removes it.
+func (b *Client) PushArchive(ctx context.Context, archivePath, image, dockerConfigJson string, tlsVerify bool, retryPolicy RetryPolicy, options PushOptions) (string, error) {
+	output, err := b.runCmd(ctx, []string{"pull", "--quiet", fmt.Sprintf("oci-archive:%s", archivePath)})
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Fields(string(output))
+	if len(lines) == 0 {
+		return "", errors.Errorf("can't get image id pulled from archive(=%s)", archivePath)
+	}
+	imageID := lines[len(lines)-1]
+	defer func() {
+		if err := b.RemoveImage(ctx, imageID); err != nil {
+			zlog.Warn().Err(err).Str("imageID", imageID).Msg("failed to remove image pulled from archive")
+		}
+	}()
+
+	args := options.args()
+	if !tlsVerify {
+		args = append(args, "--tls-verify=false")
+	}
+	if dockerConfigJson != "" {
+		authFilePath, cleanupFunc, err := b.CreateDockerAuth(imageID, dockerConfigJson)
+		if err != nil {
+			return "", errors.Wrapf(err, "can't create authfile=%s", authFilePath)
+		}
+		defer cleanupFunc()
+		args = append(args, "--authfile", authFilePath)
+	}
+	args = append(args, imageID, fmt.Sprintf("docker://%s", image))
+	return b.pushWithDigest(ctx, "PushArchive", imageID, args, retryPolicy)
+}
+
+func (b *Client) Delete(ctx context.Context, containerName string) error {
 	args := []string{"delete", containerName}
-	_, err := b.runCmd(args)
+	_, err := b.runCmd(ctx, args)
 	if err != nil {
 		return err
 	}
 	return err
 }
 
+func (b *Client) RemoveImage(ctx context.Context, image string) error {
+	args := []string{"rmi", image}
+	_, err := b.runCmd(ctx, args)
+	return err
+}
+
 func (b *Client) CreateDockerAuth(containerName, dockerConfigJson string) (string, func(), error) {
 	file, err := ioutil.TempFile("", fmt.Sprintf("%s-%s-", b.DriverName, containerName))
 	cleanUpAuthFile := func() {
@@ -212,9 +483,9 @@ func (b *Client) CreateDockerAuth(containerName, dockerConfigJson string) (strin
 	return file.Name(), cleanUpAuthFile, nil
 }
 
-func (b *Client) GarbageCollectOnce() {
+func (b *Client) GarbageCollectOnce(ctx context.Context) {
 	zlog.Info().Dur("timeout", b.GcTimeout).Msg("collecting builadh garbage")
-	out, err := b.runCmdWithTimeout([]string{"rmi", "-p"}, b.GcTimeout)
+	out, err := b.runCmdWithTimeout(ctx, []string{"rmi", "-p"}, b.GcTimeout)
 	if err != nil {
 		zlog.Error().Err(err).Str("output", string(out)).Msg("failed collecting buildah garbage")
 		return
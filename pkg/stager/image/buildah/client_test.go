@@ -0,0 +1,152 @@
+package buildah
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client", func() {
+	var dir string
+	var client *Client
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "buildah-test-")
+		Expect(err).NotTo(HaveOccurred())
+		execPath := filepath.Join(dir, "buildah")
+		Expect(ioutil.WriteFile(execPath, []byte("#!/bin/sh\nexec sleep 10\n"), 0755)).NotTo(HaveOccurred())
+		client = &Client{ExecPath: execPath, Timeout: time.Minute, GcTimeout: time.Minute}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).NotTo(HaveOccurred())
+	})
+
+	It("should kill the command when the context is canceled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		err := client.Umount(ctx, "test")
+		Expect(ClassOf(err)).Should(Equal(ErrorClassCanceled))
+		Expect(time.Since(start)).Should(BeNumerically("<", 5*time.Second))
+	})
+
+	It("should kill the command when the request deadline comes before the timeout", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(ClassOf(client.Umount(ctx, "test"))).Should(Equal(ErrorClassTimeout))
+	})
+
+	It("should kill the command when the timeout comes before the request deadline", func() {
+		client.Timeout = 50 * time.Millisecond
+		Expect(ClassOf(client.Umount(context.Background(), "test"))).Should(Equal(ErrorClassTimeout))
+	})
+
+	It("should override the timeout by the context", func() {
+		ctx := WithTimeout(context.Background(), 50*time.Millisecond)
+		Expect(ClassOf(client.Umount(ctx, "test"))).Should(Equal(ErrorClassTimeout))
+	})
+
+	It("should use GcTimeout for garbage collection", func() {
+		client.GcTimeout = 50 * time.Millisecond
+		start := time.Now()
+		client.GarbageCollectOnce(context.Background())
+		Expect(time.Since(start)).Should(BeNumerically("<", 5*time.Second))
+	})
+
+	It("should set labels to the container before committing", func() {
+		argsLog := filepath.Join(dir, "args.log")
+		Expect(ioutil.WriteFile(client.ExecPath, []byte("#!/bin/sh\necho \"$@\" >> "+argsLog+"\n"), 0755)).NotTo(HaveOccurred())
+		Expect(client.Commit(context.Background(), "test", "registry:5000/test:latest", CommitOptions{
+			Squash: true,
+			Labels: map[string]string{"b": "2", "a": "1"},
+		})).NotTo(HaveOccurred())
+
+		args, err := ioutil.ReadFile(argsLog)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(args)).Should(Equal(
+			"config --label a=1 --label b=2 test\n" +
+				"commit --format docker --squash test registry:5000/test:latest\n",
+		))
+	})
+
+	It("should override the container's config before committing", func() {
+		argsLog := filepath.Join(dir, "args.log")
+		Expect(ioutil.WriteFile(client.ExecPath, []byte("#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\" >> "+argsLog+"; done\n"), 0755)).NotTo(HaveOccurred())
+		Expect(client.Commit(context.Background(), "test", "registry:5000/test:latest", CommitOptions{
+			Config: ImageConfig{
+				Entrypoint: `["/bin/sh", "-c"]`,
+				Cmd:        "echo hello",
+				Env:        map[string]string{"FOO": "foo", "BAR": "bar"},
+				WorkingDir: "/data",
+				Author:     "ml-team",
+			},
+		})).NotTo(HaveOccurred())
+
+		args, err := ioutil.ReadFile(argsLog)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.Split(strings.TrimSpace(string(args)), "\n")).Should(Equal([]string{
+			"config",
+			"--entrypoint", `["/bin/sh", "-c"]`,
+			"--cmd", "echo hello",
+			"--env", "BAR=bar",
+			"--env", "FOO=foo",
+			"--workingdir", "/data",
+			"--author", "ml-team",
+			"test",
+			"commit", "--format", "docker", "test", "registry:5000/test:latest",
+		}))
+	})
+
+	It("should tag the image", func() {
+		argsLog := filepath.Join(dir, "args.log")
+		Expect(ioutil.WriteFile(client.ExecPath, []byte("#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\" >> "+argsLog+"; done\n"), 0755)).NotTo(HaveOccurred())
+		Expect(client.Tag(context.Background(), "registry:5000/test:v1")).NotTo(HaveOccurred())
+		Expect(argsLog).NotTo(BeAnExistingFile())
+
+		Expect(client.Tag(context.Background(), "registry:5000/test:v1", "registry:5000/test:latest", "dr:5000/test:v1")).NotTo(HaveOccurred())
+		args, err := ioutil.ReadFile(argsLog)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.Split(strings.TrimSpace(string(args)), "\n")).Should(Equal([]string{
+			"tag", "registry:5000/test:v1", "registry:5000/test:latest", "dr:5000/test:v1",
+		}))
+	})
+
+	It("should push with format and compression options", func() {
+		argsLog := filepath.Join(dir, "args.log")
+		Expect(ioutil.WriteFile(client.ExecPath, []byte("#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\" >> "+argsLog+"; done\n"), 0755)).NotTo(HaveOccurred())
+		_, err := client.Push(context.Background(), "test", "registry:5000/test:latest", "", false, RetryPolicy{}, PushOptions{
+			Format:           "oci",
+			Compression:      "zstd",
+			CompressionLevel: 3,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args, err := ioutil.ReadFile(argsLog)
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(args)), "\n")
+		// lines[2] is the temporary digest file.
+		Expect(lines[:2]).Should(Equal([]string{"push", "--digestfile"}))
+		Expect(lines[3:]).Should(Equal([]string{
+			"--format", "oci",
+			"--compression-format", "zstd",
+			"--compression-level", "3",
+			"--tls-verify=false",
+			"registry:5000/test:latest",
+		}))
+	})
+
+	It("should disable compression", func() {
+		Expect(PushOptions{Format: "docker", Compression: "uncompressed"}.args()).Should(Equal([]string{
+			"--format", "v2s2", "--disable-compression",
+		}))
+		Expect(PushOptions{}.args()).Should(BeEmpty())
+	})
+})
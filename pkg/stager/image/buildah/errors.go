@@ -0,0 +1,96 @@
+package buildah
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorClass classifies failures of buildah commands.
+type ErrorClass string
+
+const (
+	ErrorClassUnknown     ErrorClass = "Unknown"
+	ErrorClassAuth        ErrorClass = "Auth"
+	ErrorClassNotFound    ErrorClass = "NotFound"
+	ErrorClassRateLimited ErrorClass = "RateLimited"
+	ErrorClassNetwork     ErrorClass = "Network"
+	ErrorClassTimeout     ErrorClass = "Timeout"
+	ErrorClassCanceled    ErrorClass = "Canceled"
+	// ErrorClassStorageExhausted means the node's storage (or its quota) is full.
+	ErrorClassStorageExhausted ErrorClass = "StorageExhausted"
+)
+
+// IsTransient returns true for the classes whose errors may disappear by retrying.
+func (c ErrorClass) IsTransient() bool {
+	switch c {
+	case ErrorClassRateLimited, ErrorClassNetwork, ErrorClassTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// Error is returned when buildah command failed.
+type Error struct {
+	Class  ErrorClass
+	Output string
+	// Message describes the failed command and its cause.
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ClassOf returns the class of err. Besides *Error, it detects context errors and storage exhaustion of
+// local file operations.
+// It returns ErrorClassUnknown for other errors.
+func ClassOf(err error) ErrorClass {
+	switch e := errors.Cause(err).(type) {
+	case *Error:
+		return e.Class
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch errors.Cause(err) {
+	case context.Canceled:
+		return ErrorClassCanceled
+	case context.DeadlineExceeded:
+		return ErrorClassTimeout
+	}
+	if errors.Cause(err) == syscall.ENOSPC || errors.Cause(err) == syscall.EDQUOT {
+		return ErrorClassStorageExhausted
+	}
+	return ErrorClassUnknown
+}
+
+// errorPatterns are matched to buildah's output in order. The first match wins.
+var errorPatterns = []struct {
+	class   ErrorClass
+	pattern *regexp.Regexp
+}{
+	{ErrorClassStorageExhausted, regexp.MustCompile(`(?i)no space left on device|disk quota exceeded`)},
+	{ErrorClassRateLimited, regexp.MustCompile(`(?i)toomanyrequests|too many requests|\b429\b|rate limit`)},
+	{ErrorClassAuth, regexp.MustCompile(`(?i)unauthorized|authentication required|\b401\b|denied:|access to the resource is denied|\b403\b|forbidden|invalid username/password`)},
+	{ErrorClassNotFound, regexp.MustCompile(`(?i)manifest unknown|name unknown|not found|\b404\b|no such image`)},
+	{ErrorClassTimeout, regexp.MustCompile(`(?i)i/o timeout|deadline exceeded|timed out|timeout`)},
+	{ErrorClassNetwork, regexp.MustCompile(`(?i)connection refused|connection reset|no such host|network is unreachable|tls handshake|unexpected eof|broken pipe|temporary failure|\b50[234]\b|service unavailable|bad gateway`)},
+}
+
+// classifyOutput classifies the failure by buildah's output.
+func classifyOutput(output []byte) ErrorClass {
+	for _, p := range errorPatterns {
+		if p.pattern.Match(output) {
+			return p.class
+		}
+	}
+	return ErrorClassUnknown
+}
@@ -0,0 +1,90 @@
+package buildah
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("Error classification", func() {
+	DescribeTable("classifyOutput",
+		func(output string, expected ErrorClass) {
+			Expect(classifyOutput([]byte(output))).Should(Equal(expected))
+		},
+		Entry("auth", "error creating build container: unauthorized: authentication required", ErrorClassAuth),
+		Entry("not found", "reading manifest latest in docker.io/library/nonexistent: manifest unknown: manifest unknown", ErrorClassNotFound),
+		Entry("rate limited", "toomanyrequests: You have reached your pull rate limit.", ErrorClassRateLimited),
+		Entry("network", "pinging docker registry returned: Get https://registry:5000/v2/: dial tcp 10.0.0.1:5000: connect: connection refused", ErrorClassNetwork),
+		Entry("service unavailable", "received unexpected HTTP status: 503 Service Unavailable", ErrorClassNetwork),
+		Entry("timeout", "Get https://registry:5000/v2/: dial tcp 10.0.0.1:5000: i/o timeout", ErrorClassTimeout),
+		Entry("storage exhausted", "error committing container: write /var/lib/containers/storage/overlay/l/ABC: no space left on device", ErrorClassStorageExhausted),
+		Entry("unknown", "exit status 125", ErrorClassUnknown),
+	)
+
+	It("should return class of wrapped errors", func() {
+		err := errors.Wrap(&Error{Class: ErrorClassAuth, Message: "denied"}, "can't push")
+		Expect(ClassOf(err)).Should(Equal(ErrorClassAuth))
+		Expect(ClassOf(errors.New("other"))).Should(Equal(ErrorClassUnknown))
+		Expect(ClassOf(errors.Wrap(&os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.ENOSPC}, "can't save"))).Should(Equal(ErrorClassStorageExhausted))
+	})
+
+	It("should classify failed commands", func() {
+		dir, err := ioutil.TempDir("", "buildah-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		execPath := filepath.Join(dir, "buildah")
+		Expect(ioutil.WriteFile(execPath, []byte("#!/bin/sh\necho 'unauthorized: authentication required'\nexit 1\n"), 0755)).NotTo(HaveOccurred())
+
+		client := &Client{ExecPath: execPath}
+		err = client.From(context.Background(), "test", "busybox:latest", "", true, RetryPolicy{MaxAttempts: 3})
+		Expect(err).To(HaveOccurred())
+		Expect(ClassOf(err)).Should(Equal(ErrorClassAuth))
+	})
+})
+
+var _ = Describe("retry", func() {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+	failing := func(classes ...ErrorClass) (func() error, *int) {
+		attempts := 0
+		return func() error {
+			attempts++
+			if attempts > len(classes) {
+				return nil
+			}
+			return &Error{Class: classes[attempts-1], Message: string(classes[attempts-1])}
+		}, &attempts
+	}
+
+	It("should retry transient errors", func() {
+		fn, attempts := failing(ErrorClassNetwork, ErrorClassRateLimited)
+		Expect(retry(context.Background(), policy, "test", fn)).NotTo(HaveOccurred())
+		Expect(*attempts).Should(Equal(3))
+	})
+
+	It("should give up after max attempts", func() {
+		fn, attempts := failing(ErrorClassTimeout, ErrorClassTimeout, ErrorClassTimeout, ErrorClassTimeout)
+		Expect(ClassOf(retry(context.Background(), policy, "test", fn))).Should(Equal(ErrorClassTimeout))
+		Expect(*attempts).Should(Equal(3))
+	})
+
+	It("should not retry non transient errors", func() {
+		fn, attempts := failing(ErrorClassNotFound)
+		Expect(ClassOf(retry(context.Background(), policy, "test", fn))).Should(Equal(ErrorClassNotFound))
+		Expect(*attempts).Should(Equal(1))
+	})
+
+	It("should not retry when max attempts is not set", func() {
+		fn, attempts := failing(ErrorClassNetwork)
+		Expect(retry(context.Background(), RetryPolicy{}, "test", fn)).To(HaveOccurred())
+		Expect(*attempts).Should(Equal(1))
+	})
+})
@@ -0,0 +1,61 @@
+package buildah
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+// RetryPolicy configures retries on transient errors (see ErrorClass.IsTransient).
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt. Values less than 1 are treated as 1.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// retry calls fn until it succeeds, fails with non transient error, reaches max attempts or ctx is done.
+// Backoff doubles on each retry up to MaxBackoff and is jittered in [backoff/2, backoff).
+func retry(ctx context.Context, policy RetryPolicy, operation string, fn func() error) error {
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		class := ClassOf(err)
+		if attempt >= policy.MaxAttempts || !class.IsTransient() {
+			return err
+		}
+
+		wait := jitter(backoff)
+		zlog.Warn().
+			Err(err).
+			Str("Operation", operation).
+			Str("ErrorClass", string(class)).
+			Int("Attempt", attempt).
+			Int("MaxAttempts", policy.MaxAttempts).
+			Dur("Backoff", wait).
+			Msg("transient error. retry later")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
@@ -0,0 +1,216 @@
+package buildah
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// PathFilter selects files by patterns (see filepath.Match) relative to the root.
+// A pattern matching a directory matches everything under it. Exclude wins over Include,
+// and empty Include includes everything.
+type PathFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Match returns true when the path relative to the root is selected.
+func (f PathFilter) Match(path string) bool {
+	if matchAny(f.Exclude, path) {
+		return false
+	}
+	return len(f.Include) == 0 || matchAny(f.Include, path)
+}
+
+// matchAny returns true when any pattern matches the path or its parent directories.
+func matchAny(patterns []string, path string) bool {
+	for p := filepath.Clean(path); p != "." && p != "/"; p = filepath.Dir(p) {
+		for _, pattern := range patterns {
+			if pattern == "" {
+				return true
+			}
+			if ok, _ := filepath.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commitScratch commits the files written to the container (i.e. the upper directory of its overlay mount)
+// as a single layer on an empty image. The files are copied to a temporary scratch container.
+func (b *Client) commitScratch(ctx context.Context, containerName, image string, options CommitOptions) error {
+	upperDir, err := b.upperDir(ctx, containerName)
+	if err != nil {
+		return err
+	}
+
+	scratch := containerName + "-scratch"
+	// a scratch container may be left when the driver was killed while committing.
+	if exists, err := b.IsContainerExist(ctx, scratch); err != nil {
+		return err
+	} else if exists {
+		if err := b.Delete(ctx, scratch); err != nil {
+			return errors.Wrapf(err, "can't delete scratch container(name=%s)", scratch)
+		}
+	}
+	if _, err := b.runCmd(ctx, []string{"from", "--name", scratch, "scratch"}); err != nil {
+		return errors.Wrapf(err, "can't create scratch container(name=%s)", scratch)
+	}
+	defer func() {
+		if err := b.Delete(ctx, scratch); err != nil {
+			zlog.Warn().Err(err).Str("Container", scratch).Msg("failed to delete scratch container")
+		}
+	}()
+	mountPoint, err := b.Mount(ctx, scratch)
+	if err != nil {
+		return err
+	}
+	copied, err := copyFiltered(upperDir, mountPoint, options.Filter)
+	if err != nil {
+		return errors.Wrapf(err, "can't copy files of container(name=%s) to scratch container(name=%s)", containerName, scratch)
+	}
+	zlog.Debug().Str("Container", containerName).Str("Image", image).Int("Files", copied).Msg("copied files to scratch container")
+	if err := b.Umount(ctx, scratch); err != nil {
+		return err
+	}
+	return b.commit(ctx, scratch, image, options)
+}
+
+// upperDir returns the upper directory of the container's overlay mount. Only the overlay storage driver is supported.
+func (b *Client) upperDir(ctx context.Context, containerName string) (string, error) {
+	output, err := b.runCmd(ctx, []string{"inspect", "--type", "container", "--format", "{{.MountPoint}}", containerName})
+	if err != nil {
+		return "", err
+	}
+	mountPoint := strings.TrimSpace(string(output))
+	if mountPoint == "" || filepath.Base(mountPoint) != "merged" {
+		return "", errors.Errorf("container(name=%s) must be mounted with overlay storage driver to commit on scratch", containerName)
+	}
+	upperDir := filepath.Join(filepath.Dir(mountPoint), "diff")
+	if _, err := os.Stat(upperDir); err != nil {
+		return "", errors.Wrapf(err, "can't find upper directory of container(name=%s)", containerName)
+	}
+	return upperDir, nil
+}
+
+// copyFiltered copies the files selected by filter from srcRoot to dstRoot with their modes, owners and
+// modification times. Parent directories of selected files are copied as well. Overlay whiteouts and
+// special files are skipped. It returns the number of copied files.
+func copyFiltered(srcRoot, dstRoot string, filter PathFilter) (int, error) {
+	copied := 0
+	err := filepath.Walk(srcRoot, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcRoot, src)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if matchAny(filter.Exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// directories are walked even if they aren't included because files under them can be.
+		if !filter.Match(rel) {
+			return nil
+		}
+		if err := copyParents(srcRoot, dstRoot, rel); err != nil {
+			return err
+		}
+		if err := copyEntry(src, filepath.Join(dstRoot, rel), info); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			copied++
+		}
+		return nil
+	})
+	return copied, err
+}
+
+// copyParents copies the parent directories of rel which don't exist in dstRoot yet.
+func copyParents(srcRoot, dstRoot, rel string) error {
+	parent := filepath.Dir(rel)
+	if parent == "." {
+		return nil
+	}
+	if _, err := os.Lstat(filepath.Join(dstRoot, parent)); err == nil {
+		return nil
+	}
+	if err := copyParents(srcRoot, dstRoot, parent); err != nil {
+		return err
+	}
+	info, err := os.Lstat(filepath.Join(srcRoot, parent))
+	if err != nil {
+		return err
+	}
+	return copyEntry(filepath.Join(srcRoot, parent), filepath.Join(dstRoot, parent), info)
+}
+
+func copyEntry(src, dst string, info os.FileInfo) error {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		if err := os.Mkdir(dst, mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case mode.IsRegular():
+		if err := copyFile(src, dst, mode.Perm()); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	default:
+		// whiteouts (character devices 0/0) of deleted files and other special files.
+		return nil
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	// chmod again because the mode passed to Mkdir and OpenFile is masked by umask.
+	if err := os.Chmod(dst, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,87 @@
+package buildah
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PathFilter", func() {
+	It("should include everything without Include", func() {
+		Expect(PathFilter{}.Match("outputs/result.csv")).Should(BeTrue())
+	})
+
+	It("should match patterns against the path and its parent directories", func() {
+		filter := PathFilter{Include: []string{"outputs", "*.log"}, Exclude: []string{"outputs/tmp", "outputs/*.swp"}}
+		Expect(filter.Match("outputs")).Should(BeTrue())
+		Expect(filter.Match("outputs/result.csv")).Should(BeTrue())
+		Expect(filter.Match("train.log")).Should(BeTrue())
+		Expect(filter.Match("outputs/tmp/cache")).Should(BeFalse())
+		Expect(filter.Match("outputs/.result.csv.swp")).Should(BeFalse())
+		Expect(filter.Match("inputs/data.csv")).Should(BeFalse())
+	})
+})
+
+var _ = Describe("copyFiltered", func() {
+	var src, dst string
+
+	BeforeEach(func() {
+		var err error
+		src, err = ioutil.TempDir("", "scratch-src-")
+		Expect(err).NotTo(HaveOccurred())
+		dst, err = ioutil.TempDir("", "scratch-dst-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(src)).NotTo(HaveOccurred())
+		Expect(os.RemoveAll(dst)).NotTo(HaveOccurred())
+	})
+
+	write := func(path string, perm os.FileMode) {
+		Expect(os.MkdirAll(filepath.Dir(filepath.Join(src, path)), 0750)).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(src, path), []byte(path), perm)).NotTo(HaveOccurred())
+	}
+
+	It("should copy selected files with their parent directories and modes", func() {
+		write("a/b/result.csv", 0640)
+		write("a/b/run.sh", 0755)
+		write("a/tmp/cache", 0644)
+		write("inputs/data.csv", 0644)
+		Expect(os.Symlink("b/result.csv", filepath.Join(src, "a", "latest.csv"))).NotTo(HaveOccurred())
+
+		copied, err := copyFiltered(src, dst, PathFilter{Include: []string{"a"}, Exclude: []string{"a/tmp"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(copied).Should(Equal(3))
+
+		bytes, err := ioutil.ReadFile(filepath.Join(dst, "a", "b", "result.csv"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bytes)).Should(Equal("a/b/result.csv"))
+		info, err := os.Stat(filepath.Join(dst, "a", "b", "run.sh"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).Should(Equal(os.FileMode(0755)))
+		info, err = os.Stat(filepath.Join(dst, "a", "b"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).Should(Equal(os.FileMode(0750)))
+		target, err := os.Readlink(filepath.Join(dst, "a", "latest.csv"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(target).Should(Equal("b/result.csv"))
+
+		Expect(filepath.Join(dst, "a", "tmp")).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(dst, "inputs")).NotTo(BeAnExistingFile())
+	})
+
+	It("should copy parent directories of files included by patterns", func() {
+		write("a/b/result.csv", 0644)
+		write("a/b/model.bin", 0644)
+
+		copied, err := copyFiltered(src, dst, PathFilter{Include: []string{"a/*/*.csv"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(copied).Should(Equal(1))
+		Expect(filepath.Join(dst, "a", "b", "result.csv")).To(BeAnExistingFile())
+		Expect(filepath.Join(dst, "a", "b", "model.bin")).NotTo(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,65 @@
+package image
+
+import (
+	"time"
+
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+	"github.com/pkg/errors"
+)
+
+// commitOptions returns options to commit the volume's image with provenance labels, stage-out/labels,
+// stage-out/config.* overrides and stage-out/base.
+func (stager *Stager) commitOptions(vol *Volume) (buildah.CommitOptions, error) {
+	labels := map[string]string{}
+	for key, value := range vol.Spec.StageOutSpec.Labels {
+		rendered, err := renderTemplate(key, value, vol)
+		if err != nil {
+			return buildah.CommitOptions{}, errors.Wrapf(err, "can't render label(=%s)", key)
+		}
+		labels[key] = rendered
+	}
+
+	labels[api.PodNamespaceLabel] = vol.PodInfo.Namespace
+	labels[api.PodNameLabel] = vol.PodInfo.Name
+	labels[api.PodUIDLabel] = string(vol.PodInfo.UID)
+	labels[api.PodServiceAccountLabel] = vol.PodInfo.ServiceAccountName
+	labels[api.StageInImageLabel] = vol.Spec.StageInSpec.Image
+	labels[api.CommittedAtLabel] = vol.Clock.Now().UTC().Format(time.RFC3339)
+	if vol.StageInDigest != "" {
+		labels[api.StageInDigestLabel] = vol.StageInDigest
+	}
+	if stager.NodeID != "" {
+		labels[api.NodeIDLabel] = stager.NodeID
+	}
+	if stager.DriverVersion != "" {
+		labels[api.DriverVersionLabel] = stager.DriverVersion
+	}
+
+	config := vol.Spec.StageOutSpec.Config
+	return buildah.CommitOptions{
+		Format:  vol.Spec.StageOutSpec.Format,
+		Squash:  vol.Spec.StageOutSpec.Squash,
+		Scratch: vol.Spec.StageOutSpec.Base == api.StageOutBaseScratch,
+		Filter: buildah.PathFilter{
+			Include: vol.Spec.StageOutSpec.Include,
+			Exclude: vol.Spec.StageOutSpec.Exclude,
+		},
+		Labels: labels,
+		Config: buildah.ImageConfig{
+			Entrypoint: config.Entrypoint,
+			Cmd:        config.Cmd,
+			Env:        config.Env,
+			WorkingDir: config.WorkingDir,
+			Author:     config.Author,
+		},
+	}, nil
+}
+
+func pushOptions(spec api.StageOutSpec) buildah.PushOptions {
+	return buildah.PushOptions{
+		Format:           spec.Format,
+		Compression:      spec.Compression,
+		CompressionLevel: spec.CompressionLevel,
+	}
+}
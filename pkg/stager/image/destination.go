@@ -0,0 +1,87 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+)
+
+// Destination is a reference which the staged-out image is pushed to.
+type Destination struct {
+	Image string `json:"image"`
+	// Required destinations fail stage-out when pushing to them fails.
+	Required bool   `json:"required"`
+	Pushed   bool   `json:"pushed"`
+	Digest   string `json:"digest,omitempty"`
+	// Error is the error of the last push to the destination.
+	Error string `json:"error,omitempty"`
+}
+
+// newDestinations combines the repositories and the tags. The first destination is repository:tags[0].
+// Duplicated references are pushed once. Required ones win.
+func newDestinations(repository string, spec api.StageOutSpec, tags []string, withMirrors bool) []Destination {
+	type repo struct {
+		name     string
+		required bool
+	}
+	repos := []repo{{repository, true}}
+	if withMirrors {
+		for _, mirror := range spec.MirrorRepositories {
+			repos = append(repos, repo{mirror, true})
+		}
+		for _, mirror := range spec.OptionalMirrorRepositories {
+			repos = append(repos, repo{mirror, false})
+		}
+	}
+
+	destinations := []Destination{}
+	seen := map[string]bool{}
+	for _, r := range repos {
+		for _, tag := range tags {
+			image := fmt.Sprintf("%s:%s", r.name, tag)
+			if seen[image] {
+				continue
+			}
+			seen[image] = true
+			destinations = append(destinations, Destination{Image: image, Required: r.required})
+		}
+	}
+	return destinations
+}
+
+// destinations returns Destinations. Volumes staged out before mirrors were supported only have ImageToPush.
+func (vol *Volume) destinations() []Destination {
+	if len(vol.Destinations) == 0 && vol.ImageToPush != "" {
+		vol.Destinations = []Destination{{Image: vol.ImageToPush, Required: true}}
+	}
+	return vol.Destinations
+}
+
+// reportedDestinations returns nil for a single destination because ImageToPush and PushedDigest tell its outcome.
+func reportedDestinations(destinations []Destination) []Destination {
+	if len(destinations) <= 1 {
+		return nil
+	}
+	return append([]Destination{}, destinations...)
+}
+
+// destinationsMessage formats destinations for event messages (e.g. " destinations=[a:1(pushed) b:1(failed)]").
+// It is empty for a single destination.
+func destinationsMessage(destinations []Destination) string {
+	if len(destinations) <= 1 {
+		return ""
+	}
+	descs := make([]string, 0, len(destinations))
+	for _, d := range destinations {
+		state := "pending"
+		switch {
+		case d.Pushed:
+			state = "pushed"
+		case d.Error != "":
+			state = "failed"
+		}
+		descs = append(descs, fmt.Sprintf("%s(%s)", d.Image, state))
+	}
+	return fmt.Sprintf(" destinations=[%s]", strings.Join(descs, " "))
+}
@@ -0,0 +1,432 @@
+package fake
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/pkg/errors"
+)
+
+var _ image.Backend = &Backend{}
+
+// Container is an in-memory counterpart of a buildah container.
+type Container struct {
+	Name       string
+	Image      string
+	MountPoint string
+}
+
+// Backend is an in-memory image.Backend for tests.
+// Mount() provisions a real directory under RootDir so that callers can read and write files in it.
+type Backend struct {
+	RootDir string
+
+	mutex            sync.Mutex
+	errors           map[string]error
+	registryErrors   map[string]error
+	containers       map[string]*Container
+	images           map[string]string
+	commitOptions    map[string]buildah.CommitOptions
+	commits          map[string]int
+	imageFiles       map[string][]string
+	pushOptions      map[string]buildah.PushOptions
+	pushCredentials  map[string]string
+	pushed           []string
+	garbageCollected int
+}
+
+func NewBackend(rootDir string) *Backend {
+	return &Backend{
+		RootDir:         rootDir,
+		errors:          map[string]error{},
+		registryErrors:  map[string]error{},
+		containers:      map[string]*Container{},
+		images:          map[string]string{},
+		commitOptions:   map[string]buildah.CommitOptions{},
+		commits:         map[string]int{},
+		imageFiles:      map[string][]string{},
+		pushOptions:     map[string]buildah.PushOptions{},
+		pushCredentials: map[string]string{},
+	}
+}
+
+// SetError makes the method (e.g. "Push") fail with err. nil err clears it.
+func (b *Backend) SetError(method string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		delete(b.errors, method)
+		return
+	}
+	b.errors[method] = err
+}
+
+// injectedError returns the error set by SetError. It also fails like buildah.Client when ctx is done.
+func (b *Backend) injectedError(ctx context.Context, method string) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return &buildah.Error{Class: buildah.ErrorClassCanceled, Message: method + " canceled"}
+	case context.DeadlineExceeded:
+		return &buildah.Error{Class: buildah.ErrorClassTimeout, Message: method + " timeout"}
+	}
+	return b.errors[method]
+}
+
+// SetRegistryError makes Push and PushArchive to the registry fail with err. nil err clears it.
+func (b *Backend) SetRegistryError(registry string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		delete(b.registryErrors, registry)
+		return
+	}
+	b.registryErrors[registry] = err
+}
+
+func (b *Backend) IsContainerExist(ctx context.Context, containerName string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "IsContainerExist"); err != nil {
+		return false, err
+	}
+	_, ok := b.containers[containerName]
+	return ok, nil
+}
+
+func (b *Backend) ListContainers(ctx context.Context) (map[string]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "ListContainers"); err != nil {
+		return nil, err
+	}
+	containers := map[string]string{}
+	for name, c := range b.containers {
+		containers[name] = c.MountPoint
+	}
+	return containers, nil
+}
+
+func (b *Backend) From(ctx context.Context, containerName, image, dockerConfigJson string, tlsVerify bool, retryPolicy buildah.RetryPolicy) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "From"); err != nil {
+		return err
+	}
+	if _, ok := b.containers[containerName]; ok {
+		return errors.Errorf("container(name=%s) already exists", containerName)
+	}
+	b.containers[containerName] = &Container{Name: containerName, Image: image}
+	return nil
+}
+
+// FromImageDigest returns Digest(image) of the container's image.
+func (b *Backend) FromImageDigest(ctx context.Context, containerName string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "FromImageDigest"); err != nil {
+		return "", err
+	}
+	c, ok := b.containers[containerName]
+	if !ok {
+		return "", errors.Errorf("container(name=%s) not found", containerName)
+	}
+	return Digest(c.Image), nil
+}
+
+func (b *Backend) Mount(ctx context.Context, containerName string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "Mount"); err != nil {
+		return "", err
+	}
+	c, ok := b.containers[containerName]
+	if !ok {
+		return "", errors.Errorf("container(name=%s) not found", containerName)
+	}
+	mountPoint := filepath.Join(b.RootDir, containerName)
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return "", err
+	}
+	c.MountPoint = mountPoint
+	return mountPoint, nil
+}
+
+func (b *Backend) Umount(ctx context.Context, containerName string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "Umount"); err != nil {
+		return err
+	}
+	c, ok := b.containers[containerName]
+	if !ok {
+		return errors.Errorf("container(name=%s) not found", containerName)
+	}
+	c.MountPoint = ""
+	return nil
+}
+
+// IsModified returns true when any file exists in the container's mount point.
+func (b *Backend) IsModified(ctx context.Context, containerName string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "IsModified"); err != nil {
+		return false, err
+	}
+	c, ok := b.containers[containerName]
+	if !ok {
+		return false, errors.Errorf("container(name=%s) not found", containerName)
+	}
+	if c.MountPoint == "" {
+		return true, nil
+	}
+	entries, err := ioutil.ReadDir(c.MountPoint)
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+func (b *Backend) Commit(ctx context.Context, containerName, image string, options buildah.CommitOptions) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "Commit"); err != nil {
+		return err
+	}
+	c, ok := b.containers[containerName]
+	if !ok {
+		return errors.Errorf("container(name=%s) not found", containerName)
+	}
+	if options.Scratch {
+		files, err := filteredFiles(c.MountPoint, options.Filter)
+		if err != nil {
+			return err
+		}
+		b.imageFiles[image] = files
+	}
+	b.images[image] = containerName
+	b.commitOptions[image] = options
+	b.commits[image]++
+	return nil
+}
+
+// filteredFiles returns files under root selected by filter. Every file in the fake container is regarded as written.
+func filteredFiles(root string, filter buildah.PathFilter) ([]string, error) {
+	files := []string{}
+	if root == "" {
+		return files, nil
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && filter.Match(rel) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// ImageFiles returns the files of the image committed on scratch in lexical order.
+func (b *Backend) ImageFiles(image string) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.imageFiles[image]
+}
+
+// ImageLabels returns the labels of the committed image.
+func (b *Backend) ImageLabels(image string) map[string]string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.commitOptions[image].Labels
+}
+
+// ImageConfig returns the config overrides of the committed image.
+func (b *Backend) ImageConfig(image string) buildah.ImageConfig {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.commitOptions[image].Config
+}
+
+func (b *Backend) Tag(ctx context.Context, image string, tags ...string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "Tag"); err != nil {
+		return err
+	}
+	containerName, ok := b.images[image]
+	if !ok {
+		return errors.Errorf("image(=%s) not found", image)
+	}
+	for _, tag := range tags {
+		b.images[tag] = containerName
+		b.commitOptions[tag] = b.commitOptions[image]
+		b.imageFiles[tag] = b.imageFiles[image]
+	}
+	return nil
+}
+
+// Push returns Digest(image) as the digest.
+func (b *Backend) Push(ctx context.Context, containerName, image, dockerConfigJson string, tlsVerify bool, retryPolicy buildah.RetryPolicy, options buildah.PushOptions) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "Push"); err != nil {
+		return "", err
+	}
+	if err := b.registryErrors[util.RegistryOf(image)]; err != nil {
+		return "", err
+	}
+	if _, ok := b.images[image]; !ok {
+		return "", errors.Errorf("image(=%s) not found", image)
+	}
+	b.pushed = append(b.pushed, image)
+	b.pushOptions[image] = options
+	b.pushCredentials[image] = dockerConfigJson
+	return Digest(image), nil
+}
+
+// Digest is the fake digest of the image.
+func Digest(image string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(image)))
+}
+
+// Export writes the image name to archivePath.
+func (b *Backend) Export(ctx context.Context, image, archivePath string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "Export"); err != nil {
+		return err
+	}
+	if _, ok := b.images[image]; !ok {
+		return errors.Errorf("image(=%s) not found", image)
+	}
+	return ioutil.WriteFile(archivePath, []byte(image), 0600)
+}
+
+func (b *Backend) PushArchive(ctx context.Context, archivePath, image, dockerConfigJson string, tlsVerify bool, retryPolicy buildah.RetryPolicy, options buildah.PushOptions) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "PushArchive"); err != nil {
+		return "", err
+	}
+	if err := b.registryErrors[util.RegistryOf(image)]; err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(archivePath); err != nil {
+		return "", errors.Wrapf(err, "archive(=%s) not found", archivePath)
+	}
+	b.pushed = append(b.pushed, image)
+	b.pushOptions[image] = options
+	b.pushCredentials[image] = dockerConfigJson
+	return Digest(image), nil
+}
+
+func (b *Backend) Delete(ctx context.Context, containerName string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "Delete"); err != nil {
+		return err
+	}
+	c, ok := b.containers[containerName]
+	if !ok {
+		return errors.Errorf("container(name=%s) not found", containerName)
+	}
+	if c.MountPoint != "" {
+		if err := os.RemoveAll(c.MountPoint); err != nil {
+			return err
+		}
+	}
+	delete(b.containers, containerName)
+	return nil
+}
+
+func (b *Backend) RemoveImage(ctx context.Context, image string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.injectedError(ctx, "RemoveImage"); err != nil {
+		return err
+	}
+	if _, ok := b.images[image]; !ok {
+		return errors.Errorf("image(=%s) not found", image)
+	}
+	delete(b.images, image)
+	delete(b.commitOptions, image)
+	delete(b.imageFiles, image)
+	return nil
+}
+
+func (b *Backend) GarbageCollectOnce(ctx context.Context) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.garbageCollected++
+}
+
+// Container returns a copy of the container, or nil if it doesn't exist.
+func (b *Backend) Container(containerName string) *Container {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c, ok := b.containers[containerName]
+	if !ok {
+		return nil
+	}
+	copied := *c
+	return &copied
+}
+
+// Images returns committed image names.
+func (b *Backend) Images() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	images := make([]string, 0, len(b.images))
+	for image := range b.images {
+		images = append(images, image)
+	}
+	return images
+}
+
+// Pushed returns pushed image names in the order of pushes.
+func (b *Backend) Pushed() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string{}, b.pushed...)
+}
+
+// Commits returns how many times the image was committed.
+func (b *Backend) Commits(image string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.commits[image]
+}
+
+// PushOptions returns the options which the image was pushed with last time.
+func (b *Backend) PushOptions(image string) buildah.PushOptions {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.pushOptions[image]
+}
+
+// PushCredential returns the dockerConfigJson which the image was pushed with last time.
+func (b *Backend) PushCredential(image string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.pushCredentials[image]
+}
+
+// GarbageCollected returns how many times GarbageCollectOnce was called.
+func (b *Backend) GarbageCollected() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.garbageCollected
+}
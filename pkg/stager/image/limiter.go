@@ -0,0 +1,120 @@
+package image
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// ConcurrencyLimiter limits the number of concurrent operations (e.g. pulls or pushes) on the node.
+// Operations are limited both in total and per registry. Waiting operations acquire slots in FIFO order.
+// nil ConcurrencyLimiter doesn't limit anything.
+type ConcurrencyLimiter struct {
+	total       *semaphore
+	perRegistry map[string]*semaphore
+}
+
+// NewConcurrencyLimiter creates a limiter. Zero or negative limits mean unlimited.
+func NewConcurrencyLimiter(limit int, perRegistryLimits map[string]int) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{
+		perRegistry: map[string]*semaphore{},
+	}
+	if limit > 0 {
+		l.total = newSemaphore(limit)
+	}
+	for registry, limit := range perRegistryLimits {
+		if limit > 0 {
+			l.perRegistry[registry] = newSemaphore(limit)
+		}
+	}
+	return l
+}
+
+// Acquire blocks until the operation for the registry can run or ctx is done.
+// onWait is called with the number of waiting operations (including the caller) when the caller has to wait.
+// The returned release function must be called when the operation finished.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, registry string, onWait func(waiting int)) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	// acquire the registry's slot first so that operations waiting for busy registries don't occupy total slots.
+	releaseRegistry, err := l.perRegistry[registry].acquire(ctx, onWait)
+	if err != nil {
+		return nil, err
+	}
+	releaseTotal, err := l.total.acquire(ctx, onWait)
+	if err != nil {
+		releaseRegistry()
+		return nil, err
+	}
+	return func() {
+		releaseTotal()
+		releaseRegistry()
+	}, nil
+}
+
+// semaphore is a counting semaphore which wakes waiters in FIFO order.
+// nil semaphore is never blocked.
+type semaphore struct {
+	mutex   sync.Mutex
+	size    int
+	used    int
+	waiters *list.List
+}
+
+func newSemaphore(size int) *semaphore {
+	return &semaphore{
+		size:    size,
+		waiters: list.New(),
+	}
+}
+
+func (s *semaphore) acquire(ctx context.Context, onWait func(waiting int)) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	s.mutex.Lock()
+	// new comers can't overtake waiters.
+	if s.used < s.size && s.waiters.Len() == 0 {
+		s.used++
+		s.mutex.Unlock()
+		return s.release, nil
+	}
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(ready)
+	waiting := s.waiters.Len()
+	s.mutex.Unlock()
+
+	if onWait != nil {
+		onWait(waiting)
+	}
+	select {
+	case <-ready:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mutex.Lock()
+		select {
+		case <-ready:
+			s.mutex.Unlock()
+			// the slot has been handed over in the meantime.
+			s.release()
+		default:
+			s.waiters.Remove(elem)
+			s.mutex.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *semaphore) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if front := s.waiters.Front(); front != nil {
+		// hand over the slot to the first waiter.
+		s.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	s.used--
+}
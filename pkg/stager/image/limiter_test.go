@@ -0,0 +1,105 @@
+package image_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConcurrencyLimiter", func() {
+	acquire := func(limiter *image.ConcurrencyLimiter, registry string, onWait func(int)) func() {
+		release, err := limiter.Acquire(context.Background(), registry, onWait)
+		Expect(err).NotTo(HaveOccurred())
+		return release
+	}
+
+	// startWaiting starts an operation in background. It returns after the operation started waiting.
+	startWaiting := func(ctx context.Context, limiter *image.ConcurrencyLimiter, registry string, acquired chan<- func(), failed chan<- error) {
+		waiting := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			release, err := limiter.Acquire(ctx, registry, func(int) { close(waiting) })
+			if err != nil {
+				failed <- err
+				return
+			}
+			acquired <- release
+		}()
+		Eventually(waiting).Should(BeClosed())
+	}
+
+	It("should not limit anything when it is nil", func() {
+		var limiter *image.ConcurrencyLimiter
+		for i := 0; i < 10; i++ {
+			acquire(limiter, "docker.io", func(int) { Fail("should not wait") })
+		}
+	})
+
+	It("should wake waiting operations in FIFO order", func() {
+		limiter := image.NewConcurrencyLimiter(1, nil)
+		release := acquire(limiter, "docker.io", nil)
+
+		acquired := make([]chan func(), 3)
+		for i := range acquired {
+			acquired[i] = make(chan func(), 1)
+			startWaiting(context.Background(), limiter, "docker.io", acquired[i], nil)
+		}
+
+		release()
+		for i := range acquired {
+			var r func()
+			Eventually(acquired[i]).Should(Receive(&r))
+			// later waiters are still blocked
+			for j := i + 1; j < len(acquired); j++ {
+				Consistently(acquired[j], 10*time.Millisecond).ShouldNot(Receive())
+			}
+			r()
+		}
+	})
+
+	It("should limit operations per registry", func() {
+		limiter := image.NewConcurrencyLimiter(0, map[string]int{"registry:5000": 1})
+		release := acquire(limiter, "registry:5000", nil)
+
+		// other registries are not limited
+		acquire(limiter, "docker.io", func(int) { Fail("should not wait") })()
+
+		acquired := make(chan func(), 1)
+		startWaiting(context.Background(), limiter, "registry:5000", acquired, nil)
+		Consistently(acquired, 10*time.Millisecond).ShouldNot(Receive())
+		release()
+		Eventually(acquired).Should(Receive())
+	})
+
+	It("should report the number of waiting operations", func() {
+		limiter := image.NewConcurrencyLimiter(1, nil)
+		release := acquire(limiter, "docker.io", nil)
+		defer release()
+
+		waitings := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go limiter.Acquire(context.Background(), "docker.io", func(waiting int) { waitings <- waiting })
+			var waiting int
+			Eventually(waitings).Should(Receive(&waiting))
+			Expect(waiting).Should(Equal(i + 1))
+		}
+	})
+
+	It("should stop waiting when the context is canceled", func() {
+		limiter := image.NewConcurrencyLimiter(1, nil)
+		release := acquire(limiter, "docker.io", nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		failed := make(chan error, 1)
+		startWaiting(ctx, limiter, "docker.io", nil, failed)
+		cancel()
+		Eventually(failed).Should(Receive(Equal(context.Canceled)))
+
+		// the canceled operation doesn't take the slot
+		release()
+		acquire(limiter, "docker.io", func(int) { Fail("should not wait") })()
+	})
+})
@@ -0,0 +1,220 @@
+package image
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// CloudEventTypePrefix prefixes event reasons (e.g. "io.k8s.csi.stager.image.StageOutSucceeded").
+	CloudEventTypePrefix = "io.k8s.csi.stager.image."
+	// SignatureHeader has "sha256=<hex encoded HMAC-SHA256 of the body>" when Notifier.Secret is set.
+	SignatureHeader = "X-Stager-Signature-256"
+
+	defaultNotifyMaxAttempts = 3
+	defaultNotifyBackoff     = time.Second
+	defaultNotifyTimeout     = 10 * time.Second
+)
+
+// notifiedReasons are the event reasons sent to notification endpoints.
+var notifiedReasons = map[string]bool{
+	"StageInStarted":    true,
+	"StageInSucceeded":  true,
+	"StageInFailed":     true,
+	"StageOutStarted":   true,
+	"StageOutSucceeded": true,
+	"StageOutFailed":    true,
+	"StageOutSkipped":   true,
+}
+
+// Notification is the data of the CloudEvents.
+type Notification struct {
+	VolumeID   string          `json:"volumeID"`
+	VolumeName string          `json:"volumeName,omitempty"`
+	Pod        NotificationPod `json:"pod"`
+	Image      string          `json:"image,omitempty"`
+	Digest     string          `json:"digest,omitempty"`
+	Message    string          `json:"message"`
+	// Destinations are set when stage-out pushes the image to more than one reference.
+	Destinations []Destination `json:"destinations,omitempty"`
+}
+
+type NotificationPod struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid"`
+}
+
+// cloudEvent is a CloudEvents v1.0 event in structured content mode.
+type cloudEvent struct {
+	SpecVersion     string       `json:"specversion"`
+	ID              string       `json:"id"`
+	Source          string       `json:"source"`
+	Type            string       `json:"type"`
+	Subject         string       `json:"subject"`
+	Time            time.Time    `json:"time"`
+	DataContentType string       `json:"datacontenttype"`
+	Data            Notification `json:"data"`
+}
+
+// Notifier posts CloudEvents of stage lifecycle to HTTP endpoints in background.
+// Failed posts are retried on network errors, 429 and 5xx responses.
+type Notifier struct {
+	// URLs receive all the notifications.
+	URLs []string
+	// Secret signs notifications. They are not signed when it is empty.
+	Secret []byte
+	// Source is the CloudEvents source attribute.
+	Source string
+	// MaxAttempts, Backoff and Client have defaults when they are zero.
+	MaxAttempts int
+	Backoff     time.Duration
+	Client      *http.Client
+
+	wg sync.WaitGroup
+}
+
+// Notify posts the notification to URLs and extraURLs. It doesn't wait for the posts.
+func (n *Notifier) Notify(reason string, data Notification, extraURLs ...string) {
+	if n == nil || !notifiedReasons[reason] {
+		return
+	}
+	urls := append(append([]string{}, n.URLs...), extraURLs...)
+	if len(urls) == 0 {
+		return
+	}
+	body, err := json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.New().String(),
+		Source:          n.Source,
+		Type:            CloudEventTypePrefix + reason,
+		Subject:         data.VolumeID,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	})
+	if err != nil {
+		zlog.Error().Err(err).Str("Reason", reason).Msg("failed to marshal notification")
+		return
+	}
+	for _, url := range urls {
+		if url == "" {
+			continue
+		}
+		n.wg.Add(1)
+		go func(url string) {
+			defer n.wg.Done()
+			if err := n.deliver(url, body); err != nil {
+				zlog.Error().Err(err).Str("URL", url).Str("Reason", reason).Str("VolumeID", data.VolumeID).Msg("failed to notify")
+			}
+		}(url)
+	}
+}
+
+// Wait waits for notifications in flight.
+func (n *Notifier) Wait() {
+	if n == nil {
+		return
+	}
+	n.wg.Wait()
+}
+
+func (n *Notifier) deliver(url string, body []byte) error {
+	maxAttempts := n.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultNotifyMaxAttempts
+	}
+	backoff := n.Backoff
+	if backoff <= 0 {
+		backoff = defaultNotifyBackoff
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retryable bool
+		if retryable, err = n.post(url, body); err == nil || !retryable || attempt >= maxAttempts {
+			return err
+		}
+		zlog.Debug().Err(err).Str("URL", url).Int("Attempt", attempt).Dur("Backoff", backoff).Msg("retrying notification")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (n *Notifier) post(url string, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrapf(err, "can't create request to %s", url)
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	if len(n.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(n.Secret, body))
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultNotifyTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, errors.Wrapf(err, "can't post to %s", url)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, errors.Errorf("%s responded %s", url, resp.Status)
+	default:
+		return false, errors.Errorf("%s responded %s", url, resp.Status)
+	}
+}
+
+// Sign returns the value of SignatureHeader for the body.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// notify sends the volume's event to Notifier.
+func (stager *Stager) notify(vol *Volume, reason, message string) {
+	if stager.Notifier == nil {
+		return
+	}
+	data := Notification{
+		VolumeID:   vol.VolumeID,
+		VolumeName: vol.VolumeName(),
+		Pod: NotificationPod{
+			Namespace: vol.podMeta.Namespace,
+			Name:      vol.podMeta.Name,
+			UID:       vol.podMeta.UID,
+		},
+		Message: message,
+	}
+	switch reason {
+	case "StageInStarted", "StageInSucceeded", "StageInFailed":
+		data.Image = vol.Spec.StageInSpec.Image
+		data.Digest = vol.StageInDigest
+	default:
+		data.Image = vol.ImageToPush
+		data.Digest = vol.PushedDigest
+		data.Destinations = reportedDestinations(vol.Destinations)
+	}
+	stager.Notifier.Notify(reason, data, vol.Spec.NotifySpec.URL)
+}
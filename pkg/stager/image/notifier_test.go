@@ -0,0 +1,219 @@
+package image_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/mount"
+)
+
+type receivedEvent struct {
+	Header http.Header
+	Body   []byte
+	Event  struct {
+		SpecVersion string             `json:"specversion"`
+		Type        string             `json:"type"`
+		Source      string             `json:"source"`
+		Subject     string             `json:"subject"`
+		Data        image.Notification `json:"data"`
+	}
+}
+
+type eventReceiver struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	events   []receivedEvent
+	statuses []int
+}
+
+// newEventReceiver responds statuses in order, then 200.
+func newEventReceiver(statuses ...int) *eventReceiver {
+	r := &eventReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		Expect(err).NotTo(HaveOccurred())
+		ev := receivedEvent{Header: req.Header, Body: body}
+		Expect(json.Unmarshal(body, &ev.Event)).NotTo(HaveOccurred())
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.events = append(r.events, ev)
+		if len(r.statuses) > 0 {
+			w.WriteHeader(r.statuses[0])
+			r.statuses = r.statuses[1:]
+		}
+	}))
+	return r
+}
+
+func (r *eventReceiver) Events() []receivedEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]receivedEvent{}, r.events...)
+}
+
+func (r *eventReceiver) Event(eventType string) *receivedEvent {
+	for _, ev := range r.Events() {
+		if ev.Event.Type == eventType {
+			return &ev
+		}
+	}
+	return nil
+}
+
+func (r *eventReceiver) Types() []string {
+	types := []string{}
+	for _, ev := range r.Events() {
+		types = append(types, ev.Event.Type)
+	}
+	return types
+}
+
+var _ = Describe("Notifier", func() {
+	var receiver *eventReceiver
+	data := image.Notification{VolumeID: "vol-1", Image: "registry:5000/test/test:latest", Message: "test"}
+
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	It("should post signed CloudEvents", func() {
+		receiver = newEventReceiver()
+		secret := []byte("secret")
+		notifier := &image.Notifier{URLs: []string{receiver.URL}, Secret: secret, Source: "test-source"}
+		notifier.Notify("StageOutSucceeded", data)
+		notifier.Wait()
+
+		events := receiver.Events()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Header.Get("Content-Type")).To(HavePrefix("application/cloudevents+json"))
+		Expect(events[0].Header.Get(image.SignatureHeader)).To(Equal(image.Sign(secret, events[0].Body)))
+		Expect(events[0].Event.SpecVersion).To(Equal("1.0"))
+		Expect(events[0].Event.Type).To(Equal(image.CloudEventTypePrefix + "StageOutSucceeded"))
+		Expect(events[0].Event.Source).To(Equal("test-source"))
+		Expect(events[0].Event.Subject).To(Equal("vol-1"))
+		Expect(events[0].Event.Data).To(Equal(data))
+	})
+
+	It("should not sign without secret", func() {
+		receiver = newEventReceiver()
+		notifier := &image.Notifier{}
+		notifier.Notify("StageInSucceeded", data, receiver.URL)
+		notifier.Wait()
+
+		events := receiver.Events()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Header.Get(image.SignatureHeader)).To(BeEmpty())
+	})
+
+	It("should retry on server errors", func() {
+		receiver = newEventReceiver(http.StatusInternalServerError, http.StatusTooManyRequests)
+		notifier := &image.Notifier{URLs: []string{receiver.URL}, Backoff: time.Millisecond}
+		notifier.Notify("StageOutFailed", data)
+		notifier.Wait()
+		Expect(receiver.Events()).To(HaveLen(3))
+	})
+
+	It("should give up after MaxAttempts", func() {
+		receiver = newEventReceiver(http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+		notifier := &image.Notifier{URLs: []string{receiver.URL}, MaxAttempts: 2, Backoff: time.Millisecond}
+		notifier.Notify("StageOutFailed", data)
+		notifier.Wait()
+		Expect(receiver.Events()).To(HaveLen(2))
+	})
+
+	It("should not retry on client errors", func() {
+		receiver = newEventReceiver(http.StatusBadRequest)
+		notifier := &image.Notifier{URLs: []string{receiver.URL}, Backoff: time.Millisecond}
+		notifier.Notify("StageOutFailed", data)
+		notifier.Wait()
+		Expect(receiver.Events()).To(HaveLen(1))
+	})
+
+	It("should ignore reasons other than stage lifecycle", func() {
+		receiver = newEventReceiver()
+		notifier := &image.Notifier{URLs: []string{receiver.URL}}
+		notifier.Notify("CheckpointSucceeded", data)
+		notifier.Wait()
+		Expect(receiver.Events()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Stager with Notifier", func() {
+	var volumeID string
+	var workDir string
+	var receiver *eventReceiver
+	var stager *image.Stager
+
+	BeforeEach(func() {
+		var err error
+		volumeID = uuid.New().String()
+		workDir, err = ioutil.TempDir("", "stager-notifier-test-")
+		Expect(err).NotTo(HaveOccurred())
+		receiver = newEventReceiver()
+		stager = &image.Stager{
+			Buildah:  fake.NewBackend(filepath.Join(workDir, "containers")),
+			Mounter:  mount.NewFakeMounter(nil),
+			Notifier: &image.Notifier{},
+		}
+	})
+
+	AfterEach(func() {
+		receiver.Close()
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	It("should notify stage lifecycle to the volume's notify/url", func() {
+		targetPath := filepath.Join(workDir, "pods", volumeID, "volumes", "kubernetes.io~csi", "my-volume", "mount")
+		Expect(os.MkdirAll(targetPath, 0777)).NotTo(HaveOccurred())
+		vol, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+			VolumeContext: map[string]string{
+				util.PodInfoNamespaceKey:          "test-ns",
+				util.PodInfoNameKey:               "test-name",
+				util.PodInfoUIDKey:                volumeID,
+				util.PodInfoServiceAccountNameKey: "test-sa",
+				api.StageOutImageRepoKey:          "registry:5000/test/test",
+				api.StageOutTagGeneratorKey:       "podUid",
+				api.NotifyURLKey:                  receiver.URL,
+			},
+		}, fakeClock, "busybox:latest")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+		Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+		stager.Notifier.Wait()
+
+		// notifications are posted concurrently.
+		Expect(receiver.Types()).To(ConsistOf([]string{
+			image.CloudEventTypePrefix + "StageInStarted",
+			image.CloudEventTypePrefix + "StageInSucceeded",
+			image.CloudEventTypePrefix + "StageOutStarted",
+			image.CloudEventTypePrefix + "StageOutSucceeded",
+		}))
+		stageIn := receiver.Event(image.CloudEventTypePrefix + "StageInSucceeded").Event.Data
+		Expect(stageIn.VolumeName).To(Equal("my-volume"))
+		Expect(stageIn.Pod.Name).To(Equal("test-name"))
+		Expect(stageIn.Image).To(Equal("busybox:latest"))
+		Expect(stageIn.Digest).To(Equal(fake.Digest("busybox:latest")))
+		stageOut := receiver.Event(image.CloudEventTypePrefix + "StageOutSucceeded").Event.Data
+		Expect(stageOut.Image).To(Equal(vol.ImageToPush))
+		Expect(stageOut.Digest).To(Equal(vol.PushedDigest))
+	})
+})
@@ -0,0 +1,123 @@
+package image
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/pkg/errors"
+)
+
+// PodOutcome is the result of the pod which the volume is published to.
+type PodOutcome string
+
+const (
+	// PodOutcomeUnknown means the pod is still running. It's retried until the outcome is known.
+	PodOutcomeUnknown   PodOutcome = "Unknown"
+	PodOutcomeSucceeded PodOutcome = "Succeeded"
+	PodOutcomeFailed    PodOutcome = "Failed"
+	// PodOutcomeNotFound means the pod was gone (e.g. force-deleted) before its outcome was known.
+	PodOutcomeNotFound PodOutcome = "NotFound"
+)
+
+// PodOutcomeResolver looks up the outcome of the volume's pod.
+type PodOutcomeResolver interface {
+	PodOutcome(vol *Volume) (PodOutcome, error)
+}
+
+// podOutcome returns the outcome kept in the volume. It's resolved and kept once it's known.
+func (stager *Stager) podOutcome(vol *Volume) (PodOutcome, error) {
+	if vol.PodOutcome != "" && vol.PodOutcome != PodOutcomeUnknown {
+		return vol.PodOutcome, nil
+	}
+	if stager.OutcomeResolver == nil {
+		return PodOutcomeUnknown, nil
+	}
+	outcome, err := stager.OutcomeResolver.PodOutcome(vol)
+	if err != nil {
+		return PodOutcomeUnknown, errors.Wrapf(err, "can't get outcome of pod(%s/%s)", vol.PodInfo.Namespace, vol.PodInfo.Name)
+	}
+	if outcome != PodOutcomeUnknown {
+		vol.PodOutcome = outcome
+	}
+	return outcome, nil
+}
+
+func needsPodOutcome(spec api.StageOutSpec) bool {
+	return spec.When == api.StageOutWhenOnSuccess || spec.When == api.StageOutWhenOnFailure || spec.RepositoryOnFailure != ""
+}
+
+// ResolvePodOutcome resolves the pod's outcome and keeps it in the volume while the pod still exists
+// (e.g. before stage-out is queued).
+func (stager *Stager) ResolvePodOutcome(vol *Volume) error {
+	if vol.ImageToPush != "" || !needsPodOutcome(vol.Spec.StageOutSpec) {
+		return nil
+	}
+	if _, err := stager.podOutcome(vol); err != nil {
+		return err
+	}
+	return stager.saveVolume(vol)
+}
+
+// prepareImageToPush decides whether to stage out the volume by stage-out/when, the pod's outcome and
+// stage-out/skipIfUnchanged. It generates the image to push unless stage-out is skipped. The decision is
+// kept in ImageToPush so that it doesn't change after the pod is gone.
+func (stager *Stager) prepareImageToPush(ctx context.Context, vol *Volume) (skipped bool, err error) {
+	// keep the tag generated before (e.g. before the driver restarted) so that one volume produces one image.
+	if vol.ImageToPush != "" {
+		return false, nil
+	}
+	spec := vol.Spec.StageOutSpec
+
+	outcome := PodOutcomeUnknown
+	if needsPodOutcome(spec) {
+		if outcome, err = stager.podOutcome(vol); err != nil {
+			return false, err
+		}
+	}
+	// the pod is still running. fail so that stage-out is retried instead of being skipped.
+	if outcome == PodOutcomeUnknown && (spec.When == api.StageOutWhenOnSuccess || spec.When == api.StageOutWhenOnFailure) {
+		return false, errors.Errorf("%s=%s but outcome of pod(%s/%s) is unknown", api.StageOutWhenKey, spec.When, vol.PodInfo.Namespace, vol.PodInfo.Name)
+	}
+
+	modified := true
+	if spec.SkipIfUnchanged && spec.When != api.StageOutWhenNever {
+		if modified, err = stager.Buildah.IsModified(ctx, vol.VolumeID); err != nil {
+			return false, errors.Wrapf(err, "can't inspect changes of Buildah container(name=%s)", vol.VolumeID)
+		}
+	}
+
+	var skipReason string
+	switch {
+	case spec.When == api.StageOutWhenNever:
+		skipReason = fmt.Sprintf("%s=%s", api.StageOutWhenKey, spec.When)
+	case spec.When == api.StageOutWhenOnSuccess && outcome != PodOutcomeSucceeded,
+		spec.When == api.StageOutWhenOnFailure && outcome != PodOutcomeFailed:
+		skipReason = fmt.Sprintf("%s=%s but pod outcome is %s", api.StageOutWhenKey, spec.When, outcome)
+	case !modified:
+		skipReason = fmt.Sprintf("%s=true and the volume is unchanged", api.StageOutSkipIfUnchangedKey)
+	}
+	if skipReason != "" {
+		stager.PublishEventIfSupported(vol, "StageOutSkipped", fmt.Sprintf("volumeID=%s reason=%s", vol.VolumeID, skipReason))
+		stager.reportStageOut(vol, api.StageOutStatusSkipped, nil)
+		return true, nil
+	}
+
+	repository := spec.ImageRepository
+	withMirrors := true
+	if outcome == PodOutcomeFailed && spec.RepositoryOnFailure != "" {
+		repository = spec.RepositoryOnFailure
+		withMirrors = false
+	}
+	tags := []string{}
+	for _, tg := range append([]tagGenerator{vol.TagGenerator}, vol.AdditionalTagGenerators...) {
+		generatedTag, err := tg.Generate(vol)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to generate image tag to stage out")
+		}
+		tags = append(tags, generatedTag)
+	}
+	vol.Destinations = newDestinations(repository, spec, tags, withMirrors)
+	vol.ImageToPush = vol.Destinations[0].Image
+	return false, stager.saveVolume(vol)
+}
@@ -0,0 +1,139 @@
+package image
+
+import (
+	"time"
+
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	zlog "github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type Stage string
+
+const (
+	StageIn  Stage = "StageIn"
+	StageOut Stage = "StageOut"
+)
+
+// PhaseTransition is the time when the volume moved to the phase.
+type PhaseTransition struct {
+	Phase Phase     `json:"phase"`
+	Time  time.Time `json:"time"`
+}
+
+// StageResult is the result of staging a volume. Empty fields are not reported.
+type StageResult struct {
+	Stage Stage
+	Pod   metav1.ObjectMeta
+	// ServiceAccount is the pod's service account.
+	ServiceAccount string
+	// VolumeName is the name of the volume in the pod.
+	VolumeName string
+	VolumeID   string
+
+	StageInImage   string
+	StageInDigest  string
+	StageOutImage  string
+	StageOutDigest string
+	StageOutStatus api.StageOutStatus
+	// Destinations are the outcomes of all the references pushed by stage-out when there are more than one.
+	Destinations []Destination
+
+	// Error is the error of the failed stage.
+	Error string
+	// Phases are the phase transitions of the stage.
+	Phases []PhaseTransition
+	// Time is when the stage finished. Duration is zero when the start of the stage is unknown.
+	Time     time.Time
+	Duration time.Duration
+}
+
+// PodReporter records results of staging volumes on their pods.
+type PodReporter interface {
+	ReportToPod(result StageResult) error
+}
+
+// StageHistory keeps results of staging volumes after their pods are gone.
+type StageHistory interface {
+	RecordStage(result StageResult) error
+}
+
+// report never fails staging volumes because results are informational.
+func (stager *Stager) report(result StageResult) {
+	stager.audit(result.auditEntry())
+	if stager.Reporter != nil {
+		if err := stager.Reporter.ReportToPod(result); err != nil {
+			zlog.Warn().Err(err).Interface("Result", result).Msg("failed to report stage result to pod")
+		}
+	}
+	if stager.History != nil {
+		if err := stager.History.RecordStage(result); err != nil {
+			zlog.Warn().Err(err).Interface("Result", result).Msg("failed to record stage result")
+		}
+	}
+}
+
+// startStage marks the start of stage-in or stage-out to measure its duration.
+func (stager *Stager) startStage(vol *Volume) {
+	vol.stageStartedAt = vol.Clock.Now()
+}
+
+func (stager *Stager) finishStage(vol *Volume) (time.Time, time.Duration) {
+	now := vol.Clock.Now()
+	var duration time.Duration
+	if !vol.stageStartedAt.IsZero() {
+		duration = now.Sub(vol.stageStartedAt)
+	}
+	vol.stageStartedAt = time.Time{}
+	return now, duration
+}
+
+func (stager *Stager) reportStageIn(vol *Volume, err error) {
+	finishedAt, duration := stager.finishStage(vol)
+	result := StageResult{
+		Stage:          StageIn,
+		Pod:            vol.podMeta,
+		ServiceAccount: vol.PodInfo.ServiceAccountName,
+		VolumeName:     vol.VolumeName(),
+		VolumeID:       vol.VolumeID,
+		StageInImage:   vol.Spec.StageInSpec.Image,
+		StageInDigest:  vol.StageInDigest,
+		Phases:         vol.PhaseTransitions,
+		Time:           finishedAt,
+		Duration:       duration,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	stager.report(result)
+}
+
+func (stager *Stager) reportStageOut(vol *Volume, status api.StageOutStatus, err error) {
+	// stage-out phases follow the last transition to Published.
+	phases := vol.PhaseTransitions
+	for i := len(phases) - 1; i >= 0; i-- {
+		if phases[i].Phase == PhasePublished {
+			phases = phases[i:]
+			break
+		}
+	}
+	finishedAt, duration := stager.finishStage(vol)
+	result := StageResult{
+		Stage:          StageOut,
+		Pod:            vol.podMeta,
+		ServiceAccount: vol.PodInfo.ServiceAccountName,
+		VolumeName:     vol.VolumeName(),
+		VolumeID:       vol.VolumeID,
+		StageOutImage:  vol.ImageToPush,
+		StageOutDigest: vol.PushedDigest,
+		StageOutStatus: status,
+		Destinations:   reportedDestinations(vol.Destinations),
+		Phases:         phases,
+		Time:           finishedAt,
+		Duration:       duration,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	stager.report(result)
+}
@@ -0,0 +1,387 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SpooledImage is an image which couldn't be pushed. It is exported to an OCI archive in the spool directory.
+type SpooledImage struct {
+	// VolumeID identifies the spooled image.
+	VolumeID string `json:"volumeID"`
+	Image    string `json:"image"`
+	// Destinations are the volume's destinations. Ones which aren't pushed yet are pushed from Archive.
+	Destinations []Destination `json:"destinations,omitempty"`
+	Archive      string        `json:"archive"`
+	TlsVerify    bool          `json:"tlsVerify"`
+	Retry        api.RetrySpec `json:"retry"`
+	// Format, Compression and CompressionLevel are stage-out/format, stage-out/compression and stage-out/compressionLevel.
+	Format           string `json:"format,omitempty"`
+	Compression      string `json:"compression,omitempty"`
+	CompressionLevel int    `json:"compressionLevel,omitempty"`
+	// Pod is the pod which the volume was published to. Events and results are recorded to it.
+	Pod            metav1.ObjectMeta `json:"pod"`
+	VolumeName     string            `json:"volumeName"`
+	ServiceAccount string            `json:"serviceAccount"`
+	// NotifyURL is the volume's notify/url.
+	NotifyURL string    `json:"notifyURL,omitempty"`
+	SpooledAt time.Time `json:"spooledAt"`
+	Attempts  int       `json:"attempts"`
+	// SecretName is the volume's NodePublishSecretRef in the pod's namespace. The secret is read again
+	// when DockerConfigJson is lost (e.g. after the driver restarted).
+	SecretName string `json:"secretName,omitempty"`
+
+	// DockerConfigJson is kept only in memory like Volume's.
+	DockerConfigJson string `json:"-"`
+}
+
+// PublishSecretResolver looks up the secrets of NodePublishSecretRef for spooled images.
+type PublishSecretResolver interface {
+	// PublishSecretName returns the name of the volume's NodePublishSecretRef. It is empty without the secret.
+	PublishSecretName(vol *Volume) (string, error)
+	// DockerConfigJson reads DockerConfigJsonKey of the secret.
+	DockerConfigJson(namespace, name string) (string, error)
+}
+
+// Spool keeps spooled images in {Dir}/{volumeID}.tar and their records in {Dir}/{volumeID}.json.
+type Spool struct {
+	Dir string
+	// MaxAttempts is the number of failed pushes after which spooled images are given up.
+	// Their archives are kept for manual recovery. Zero means no limit.
+	MaxAttempts int
+
+	mutex             sync.Mutex
+	dockerConfigJsons map[string]string
+}
+
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "can't create spool directory(=%s)", dir)
+	}
+	return &Spool{
+		Dir:               dir,
+		dockerConfigJsons: map[string]string{},
+	}, nil
+}
+
+// ArchivePath returns the path to export the volume's image to.
+func (s *Spool) ArchivePath(volumeID string) string {
+	return filepath.Join(s.Dir, volumeID+".tar")
+}
+
+func (s *Spool) recordPath(volumeID string) string {
+	return filepath.Join(s.Dir, volumeID+".json")
+}
+
+// Save writes the record of the spooled image. Its archive must be exported beforehand.
+func (s *Spool) Save(img *SpooledImage) error {
+	bytes, err := json.Marshal(img)
+	if err != nil {
+		return errors.Wrapf(err, "can't marshal spooled image(volumeID=%s)", img.VolumeID)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// write to a temporary file and rename it so that the record is never partially written.
+	tmp, err := ioutil.TempFile(s.Dir, ".tmp-"+img.VolumeID+"-")
+	if err != nil {
+		return errors.Wrapf(err, "can't create spool record for volumeID=%s", img.VolumeID)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(bytes); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "can't write spool record for volumeID=%s", img.VolumeID)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "can't write spool record for volumeID=%s", img.VolumeID)
+	}
+	if err := os.Rename(tmp.Name(), s.recordPath(img.VolumeID)); err != nil {
+		return errors.Wrapf(err, "can't write spool record(=%s)", s.recordPath(img.VolumeID))
+	}
+	if img.DockerConfigJson != "" {
+		s.dockerConfigJsons[img.VolumeID] = img.DockerConfigJson
+	}
+	return nil
+}
+
+// List returns spooled images. Broken records are skipped.
+func (s *Spool) List() ([]*SpooledImage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	images := make([]*SpooledImage, 0, len(files))
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't read spool record(=%s)", file)
+		}
+		img := &SpooledImage{}
+		if err := json.Unmarshal(bytes, img); err != nil {
+			zlog.Error().Err(err).Str("file", file).Msg("skip broken spool record")
+			continue
+		}
+		img.DockerConfigJson = s.dockerConfigJsons[img.VolumeID]
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// Remove deletes the spooled image's archive and record.
+func (s *Spool) Remove(img *SpooledImage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(img.Archive); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can't delete spooled archive(=%s)", img.Archive)
+	}
+	if err := os.Remove(s.recordPath(img.VolumeID)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can't delete spool record(=%s)", s.recordPath(img.VolumeID))
+	}
+	delete(s.dockerConfigJsons, img.VolumeID)
+	return nil
+}
+
+// Abandon deletes the spooled image's record so that it isn't retried anymore. Its archive is kept.
+func (s *Spool) Abandon(img *SpooledImage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(s.recordPath(img.VolumeID)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can't delete spool record(=%s)", s.recordPath(img.VolumeID))
+	}
+	delete(s.dockerConfigJsons, img.VolumeID)
+	return nil
+}
+
+// isSpoolEnabled returns false when the push was aborted because ctx is done.
+func (stager *Stager) isSpoolEnabled(ctx context.Context, vol *Volume) bool {
+	return stager.Spool != nil &&
+		vol.Spec.StageOutSpec.FailurePolicy == api.StageOutFailurePolicySpool &&
+		ctx.Err() == nil
+}
+
+// spool exports the image which failed to be pushed to the spool and removes the local image.
+func (stager *Stager) spool(ctx context.Context, vol *Volume) error {
+	archive := stager.Spool.ArchivePath(vol.VolumeID)
+	if err := stager.Buildah.Export(buildah.WithTimeout(ctx, vol.Spec.StageOutSpec.Timeout), vol.ImageToPush, archive); err != nil {
+		return errors.Wrapf(err, "can't export image(=%s) to archive(=%s)", vol.ImageToPush, archive)
+	}
+	img := &SpooledImage{
+		VolumeID:         vol.VolumeID,
+		Image:            vol.ImageToPush,
+		Destinations:     vol.destinations(),
+		Archive:          archive,
+		TlsVerify:        vol.Spec.StageOutSpec.TlsVerify,
+		Retry:            vol.Spec.StageOutSpec.Retry,
+		Format:           vol.Spec.StageOutSpec.Format,
+		Compression:      vol.Spec.StageOutSpec.Compression,
+		CompressionLevel: vol.Spec.StageOutSpec.CompressionLevel,
+		Pod:              vol.podMeta,
+		VolumeName:       vol.VolumeName(),
+		ServiceAccount:   vol.PodInfo.ServiceAccountName,
+		NotifyURL:        vol.Spec.NotifySpec.URL,
+		SpooledAt:        vol.Clock.Now(),
+		DockerConfigJson: vol.DockerConfigJson,
+	}
+	if vol.DockerConfigJson != "" && stager.SecretResolver != nil {
+		secretName, err := stager.SecretResolver.PublishSecretName(vol)
+		if err != nil {
+			zlog.Warn().Err(err).Str("VolumeID", vol.VolumeID).Msg("spooled image can't be pushed after the driver restarts because its secret is unknown")
+		}
+		img.SecretName = secretName
+	}
+	if err := stager.Spool.Save(img); err != nil {
+		return err
+	}
+	for _, d := range img.Destinations {
+		if err := stager.Buildah.RemoveImage(ctx, d.Image); err != nil {
+			zlog.Warn().Err(err).Str("VolumeID", vol.VolumeID).Str("Image", d.Image).Msg("failed to remove spooled image")
+		}
+	}
+	stager.PublishEventIfSupported(vol, "StageOutSpooled", fmt.Sprintf("volumeID=%s image=%s archive=%s", vol.VolumeID, vol.ImageToPush, archive))
+	stager.reportStageOut(vol, api.StageOutStatusSpooled, nil)
+	return nil
+}
+
+// PushSpooledImages retries pushing spooled images. Pushed images are removed from the spool.
+func (stager *Stager) PushSpooledImages(ctx context.Context) {
+	if stager.Spool == nil {
+		return
+	}
+	images, err := stager.Spool.List()
+	if err != nil {
+		zlog.Error().Err(err).Msg("failed to list spooled images")
+		return
+	}
+	for _, img := range images {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := stager.pushSpooledImage(ctx, img); err != nil {
+			zlog.Error().Err(err).Str("VolumeID", img.VolumeID).Str("Image", img.Image).Int("Attempts", img.Attempts).Msg("failed to push spooled image")
+		}
+	}
+}
+
+func (stager *Stager) pushSpooledImage(ctx context.Context, img *SpooledImage) error {
+	// records spooled before mirrors were supported only have Image.
+	if len(img.Destinations) == 0 {
+		img.Destinations = []Destination{{Image: img.Image, Required: true}}
+	}
+	startedAt := time.Now()
+	pushErr := stager.restoreSpooledDockerConfigJson(img)
+	if pushErr == nil {
+		for i := range img.Destinations {
+			d := &img.Destinations[i]
+			if d.Pushed {
+				continue
+			}
+			digest, err := stager.pushArchive(ctx, img, d.Image)
+			if err != nil {
+				d.Error = err.Error()
+				if d.Required && pushErr == nil {
+					pushErr = err
+				}
+				continue
+			}
+			d.Pushed, d.Digest, d.Error = true, digest, ""
+		}
+	}
+	if pushErr != nil {
+		// failed retries are only audited. the stage-out has already been reported as spooled.
+		stager.audit(AuditEntry{
+			Time:            time.Now(),
+			Operation:       AuditOperationStageOut,
+			Pod:             AuditPod{Namespace: img.Pod.Namespace, Name: img.Pod.Name, UID: img.Pod.UID},
+			ServiceAccount:  img.ServiceAccount,
+			VolumeID:        img.VolumeID,
+			VolumeName:      img.VolumeName,
+			Image:           img.Image,
+			Outcome:         string(api.StageOutStatusFailed),
+			DurationSeconds: time.Since(startedAt).Seconds(),
+			Error:           pushErr.Error(),
+			Destinations:    reportedDestinations(img.Destinations),
+		})
+		img.Attempts++
+		if stager.Spool.MaxAttempts > 0 && img.Attempts >= stager.Spool.MaxAttempts {
+			return stager.abandonSpooledImage(img, pushErr)
+		}
+		if errSave := stager.Spool.Save(img); errSave != nil {
+			zlog.Warn().Err(errSave).Str("VolumeID", img.VolumeID).Msg("failed to save spooled image")
+		}
+		return pushErr
+	}
+	finishedAt := time.Now()
+	if err := stager.Spool.Remove(img); err != nil {
+		return err
+	}
+	digest := img.Destinations[0].Digest
+	zlog.Info().Str("VolumeID", img.VolumeID).Str("Image", img.Image).Str("Digest", digest).Msg("pushed spooled image")
+	stager.publishPodEvent(img.Pod, "StageOutSucceeded", fmt.Sprintf("volumeID=%s image=%s digest=%s pushedImage=%s archive=%s%s", img.VolumeID, img.Image, digest, pushedImage(img.Image, digest), img.Archive, destinationsMessage(img.Destinations)))
+	stager.Notifier.Notify("StageOutSucceeded", Notification{
+		VolumeID:     img.VolumeID,
+		VolumeName:   img.VolumeName,
+		Pod:          NotificationPod{Namespace: img.Pod.Namespace, Name: img.Pod.Name, UID: img.Pod.UID},
+		Image:        img.Image,
+		Digest:       digest,
+		Message:      fmt.Sprintf("volumeID=%s image=%s digest=%s archive=%s", img.VolumeID, img.Image, digest, img.Archive),
+		Destinations: reportedDestinations(img.Destinations),
+	}, img.NotifyURL)
+	stager.report(StageResult{
+		Stage:          StageOut,
+		Pod:            img.Pod,
+		ServiceAccount: img.ServiceAccount,
+		VolumeName:     img.VolumeName,
+		VolumeID:       img.VolumeID,
+		StageOutImage:  img.Image,
+		StageOutDigest: digest,
+		StageOutStatus: api.StageOutStatusSucceeded,
+		Destinations:   reportedDestinations(img.Destinations),
+		Time:           finishedAt,
+		Duration:       finishedAt.Sub(startedAt),
+	})
+	return nil
+}
+
+// restoreSpooledDockerConfigJson reads the secret again when the spooled image lost its DockerConfigJson.
+func (stager *Stager) restoreSpooledDockerConfigJson(img *SpooledImage) error {
+	if img.DockerConfigJson != "" || img.SecretName == "" {
+		return nil
+	}
+	if stager.SecretResolver == nil {
+		return errors.Errorf("can't read secret(namespace=%s, name=%s) to push spooled image", img.Pod.Namespace, img.SecretName)
+	}
+	dockerConfigJson, err := stager.SecretResolver.DockerConfigJson(img.Pod.Namespace, img.SecretName)
+	if err != nil {
+		return errors.Wrapf(err, "can't restore %s of spooled image", DockerConfigJsonKey)
+	}
+	img.DockerConfigJson = dockerConfigJson
+	return nil
+}
+
+// abandonSpooledImage stops retrying the spooled image and reports the failure. Its archive is kept.
+func (stager *Stager) abandonSpooledImage(img *SpooledImage, pushErr error) error {
+	if err := stager.Spool.Abandon(img); err != nil {
+		return err
+	}
+	err := errors.Wrapf(pushErr, "gave up pushing spooled image after %d attempts", img.Attempts)
+	zlog.Error().Err(err).Str("VolumeID", img.VolumeID).Str("Image", img.Image).Str("Archive", img.Archive).Msg("gave up pushing spooled image")
+	message := fmt.Sprintf("volumeID=%s image=%s archive=%s error=%s%s", img.VolumeID, img.Image, img.Archive, err.Error(), destinationsMessage(img.Destinations))
+	stager.publishPodEvent(img.Pod, "StageOutFailed", message)
+	stager.Notifier.Notify("StageOutFailed", Notification{
+		VolumeID:     img.VolumeID,
+		VolumeName:   img.VolumeName,
+		Pod:          NotificationPod{Namespace: img.Pod.Namespace, Name: img.Pod.Name, UID: img.Pod.UID},
+		Image:        img.Image,
+		Message:      message,
+		Destinations: reportedDestinations(img.Destinations),
+	}, img.NotifyURL)
+	stager.report(StageResult{
+		Stage:          StageOut,
+		Pod:            img.Pod,
+		ServiceAccount: img.ServiceAccount,
+		VolumeName:     img.VolumeName,
+		VolumeID:       img.VolumeID,
+		StageOutImage:  img.Image,
+		StageOutStatus: api.StageOutStatusFailed,
+		Destinations:   reportedDestinations(img.Destinations),
+		Error:          err.Error(),
+		Time:           time.Now(),
+	})
+	return err
+}
+
+func (stager *Stager) pushArchive(ctx context.Context, img *SpooledImage, image string) (string, error) {
+	release, err := stager.StageOutLimiter.Acquire(ctx, util.RegistryOf(image), func(waiting int) {})
+	if err != nil {
+		return "", errors.Wrapf(err, "gave up waiting to push image(=%s)", image)
+	}
+	defer release()
+	digest, err := stager.Buildah.PushArchive(ctx, img.Archive, image, img.DockerConfigJson, img.TlsVerify, retryPolicy(img.Retry), buildah.PushOptions{
+		Format:           img.Format,
+		Compression:      img.Compression,
+		CompressionLevel: img.CompressionLevel,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "can't push image(=%s) from archive(=%s)", image, img.Archive)
+	}
+	return digest, nil
+}
@@ -1,13 +1,17 @@
 package image
 
 import (
+	"context"
 	"fmt"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/record"
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/mount"
 
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
 	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
 	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
 	"github.com/pkg/errors"
@@ -15,67 +19,181 @@ import (
 )
 
 type Stager struct {
-	Buildah  *buildah.Client
+	Buildah  Backend
 	GcPeriod time.Duration
 	Recorder record.EventRecorder
+	// Mounter mounts containers' root to volumes' targetPath.
+	// mount.New("") is used when it is nil.
+	Mounter mount.Interface
+	// Store persists volumes whenever their phases change. It is optional.
+	Store VolumeStore
+	// StageInLimiter and StageOutLimiter limit concurrent pulls and pushes. They are optional.
+	StageInLimiter  *ConcurrencyLimiter
+	StageOutLimiter *ConcurrencyLimiter
+	// OutcomeResolver is used for stage-out/when. Pod outcomes are unknown when it is nil.
+	OutcomeResolver PodOutcomeResolver
+	// Spool keeps images which failed to be pushed with stage-out/failurePolicy=Spool.
+	// The policy falls back to Fail when it is nil.
+	Spool *Spool
+	// SecretResolver reads the secrets of spooled images again after the driver restarts. It is optional.
+	SecretResolver PublishSecretResolver
+	// Reporter records stage-in/stage-out results on pods. It is optional.
+	Reporter PodReporter
+	// History keeps stage-in/stage-out results. It is optional.
+	History StageHistory
+	// Notifier posts stage lifecycle events to HTTP endpoints. It is optional.
+	Notifier *Notifier
+	// AuditLog records stage-in, stage-out and checkpoints. It is optional.
+	AuditLog *AuditLog
+	// NodeID and DriverVersion are recorded in labels of committed images.
+	NodeID        string
+	DriverVersion string
 }
 
-func (stager *Stager) publishEventIfSupported(vol *Volume, reason, message string) {
+func (stager *Stager) mounter() mount.Interface {
+	if stager.Mounter == nil {
+		return mount.New("")
+	}
+	return stager.Mounter
+}
+
+// setPhase moves the volume to the phase and persists it to Store.
+func (stager *Stager) setPhase(vol *Volume, phase Phase) error {
+	vol.Phase = phase
+	vol.PhaseTransitions = append(vol.PhaseTransitions, PhaseTransition{Phase: phase, Time: vol.Clock.Now()})
+	return stager.saveVolume(vol)
+}
+
+func (stager *Stager) saveVolume(vol *Volume) error {
+	if stager.Store == nil {
+		return nil
+	}
+	if err := stager.Store.Save(vol); err != nil {
+		return errors.Wrapf(err, "can't save volume(volumeID=%s, phase=%s)", vol.VolumeID, vol.Phase)
+	}
+	return nil
+}
+
+func (stager *Stager) PublishEventIfSupported(vol *Volume, reason, message string) {
+	stager.publishPodEvent(vol.podMeta, reason, message)
+	stager.notify(vol, reason, message)
+}
+
+func (stager *Stager) publishPodEvent(podMeta metav1.ObjectMeta, reason, message string) {
 	if stager.Recorder == nil {
-		zlog.Warn().Interface("ObjectMeta", vol.podMeta).Str("Reason", reason).Str("EventMessage", message).Msg("skip publishing event")
+		zlog.Warn().Interface("ObjectMeta", podMeta).Str("Reason", reason).Str("EventMessage", message).Msg("skip publishing event")
 		return
 	}
-	stager.Recorder.Eventf(&corev1.Pod{ObjectMeta: vol.podMeta}, corev1.EventTypeNormal, reason, message)
+	stager.Recorder.Eventf(&corev1.Pod{ObjectMeta: podMeta}, corev1.EventTypeNormal, reason, message)
 }
 
-func (stager *Stager) StageIn(vol *Volume) error {
+// acquire waits for the limiter to allow pulling/pushing the image. Waiting is reported with the reason.
+func (stager *Stager) acquire(ctx context.Context, limiter *ConcurrencyLimiter, vol *Volume, reason, image string) (release func(), err error) {
+	registry := util.RegistryOf(image)
+	return limiter.Acquire(ctx, registry, func(waiting int) {
+		zlog.Info().
+			Str("VolumeID", vol.VolumeID).
+			Str("Image", image).
+			Str("Registry", registry).
+			Int("Waiting", waiting).
+			Msg("waiting for concurrent operations to finish")
+		stager.PublishEventIfSupported(vol, reason, fmt.Sprintf("volumeID=%s image=%s registry=%s waiting=%d", vol.VolumeID, image, registry, waiting))
+	})
+}
+
+func retryPolicy(spec api.RetrySpec) buildah.RetryPolicy {
+	return buildah.RetryPolicy{
+		MaxAttempts:    spec.MaxAttempts,
+		InitialBackoff: spec.InitialBackoff,
+		MaxBackoff:     spec.MaxBackoff,
+	}
+}
+
+func (stager *Stager) resolveStageInDigest(ctx context.Context, vol *Volume) {
+	if vol.StageInDigest != "" {
+		return
+	}
+	digest, err := stager.Buildah.FromImageDigest(ctx, vol.VolumeID)
+	if err != nil {
+		zlog.Warn().Err(err).Str("VolumeID", vol.VolumeID).Msg("failed to get digest of stage-in image")
+	}
+	vol.StageInDigest = digest
+}
+
+// StageIn publishes the volume. Buildah commands are killed when ctx is done.
+func (stager *Stager) StageIn(ctx context.Context, vol *Volume) error {
 	switch vol.Phase {
 	case PhaseInitState:
-		isExist, err := stager.Buildah.IsContainerExist(vol.VolumeID)
+		isExist, err := stager.Buildah.IsContainerExist(ctx, vol.VolumeID)
 		if err != nil {
 			return errors.Wrapf(err, "check Buildah container(name=%s) existence failed", vol.VolumeID)
 		}
 		if isExist {
-			vol.Phase = PhaseContainerCreated
-			return stager.StageIn(vol)
+			if err := stager.setPhase(vol, PhaseContainerCreated); err != nil {
+				return err
+			}
+			return stager.StageIn(ctx, vol)
 		}
 
-		stager.publishEventIfSupported(vol, "StageInStarted", fmt.Sprintf("volumeID=%s image=%s", vol.VolumeID, vol.Spec.StageInSpec.Image))
-		if err := stager.Buildah.From(vol.VolumeID, vol.Spec.StageInSpec.Image, vol.DockerConfigJson, vol.Spec.StageInSpec.TlsVerify); err != nil {
-			stager.publishEventIfSupported(vol, "StageInFailed", fmt.Sprintf("volumeID=%s image=%s error=%s", vol.VolumeID, vol.Spec.StageInSpec.Image, err.Error()))
+		release, err := stager.acquire(ctx, stager.StageInLimiter, vol, "StageInWaiting", vol.Spec.StageInSpec.Image)
+		if err != nil {
+			return errors.Wrapf(err, "gave up waiting to create Buildah container(name=%s)", vol.VolumeID)
+		}
+		stager.startStage(vol)
+		stager.PublishEventIfSupported(vol, "StageInStarted", fmt.Sprintf("volumeID=%s image=%s", vol.VolumeID, vol.Spec.StageInSpec.Image))
+		err = stager.Buildah.From(buildah.WithTimeout(ctx, vol.Spec.StageInSpec.Timeout), vol.VolumeID, vol.Spec.StageInSpec.Image, vol.DockerConfigJson, vol.Spec.StageInSpec.TlsVerify, retryPolicy(vol.Spec.StageInSpec.Retry))
+		release()
+		if err != nil {
+			stager.failStageIn(vol, err)
 			return errors.Wrapf(err, "can't create Buildah container(name=%s)", vol.VolumeID)
 		}
-		stager.publishEventIfSupported(vol, "StageInSucceeded", fmt.Sprintf("volumeID=%s image=%s", vol.VolumeID, vol.Spec.StageInSpec.Image))
+		stager.resolveStageInDigest(ctx, vol)
 
-		vol.Phase = PhaseContainerCreated
-		return stager.StageIn(vol)
+		if err := stager.setPhase(vol, PhaseContainerCreated); err != nil {
+			return err
+		}
+		return stager.StageIn(ctx, vol)
 
 	case PhaseContainerCreated:
-		provisionRoot, err := stager.Buildah.Mount(vol.VolumeID)
+		provisionRoot, err := stager.Buildah.Mount(ctx, vol.VolumeID)
 		if err != nil {
-			return errors.Wrapf(err, "can't mount Buildah container(name=%s)", vol.VolumeID)
+			err = errors.Wrapf(err, "can't mount Buildah container(name=%s)", vol.VolumeID)
+			stager.failStageIn(vol, err)
+			return err
 		}
 		vol.ProvisionedRoot = provisionRoot
-		vol.Phase = PhaseContainerMounted
-		return stager.StageIn(vol)
+		if err := stager.setPhase(vol, PhaseContainerMounted); err != nil {
+			return err
+		}
+		return stager.StageIn(ctx, vol)
 
 	case PhaseContainerMounted:
 		options := []string{"bind"}
 		if vol.ReadOnly {
 			options = append(options, "ro")
 		}
-		if err := util.MountTargetPath(vol.ProvisionedRoot, vol.TargetPath, options); err != nil {
-			return errors.Wrapf(err,
+		if err := util.MountTargetPath(stager.mounter(), vol.ProvisionedRoot, vol.TargetPath, options); err != nil {
+			err = errors.Wrapf(err,
 				"can't mount Buildah container(name=%s)'vol provisioned root(=%s) to volume targetPath(=%s)",
 				vol.VolumeID, vol.ProvisionedRoot, vol.TargetPath,
 			)
+			stager.failStageIn(vol, err)
+			return err
 		}
-		vol.Phase = PhaseTargetPathMounted
-		return stager.StageIn(vol)
+		if err := stager.setPhase(vol, PhaseTargetPathMounted); err != nil {
+			return err
+		}
+		return stager.StageIn(ctx, vol)
 
 	case PhaseTargetPathMounted:
-		vol.Phase = PhasePublished
-		return stager.StageIn(vol)
+		// the container may have been created before the driver restarted.
+		stager.resolveStageInDigest(ctx, vol)
+		if err := stager.setPhase(vol, PhasePublished); err != nil {
+			return err
+		}
+		stager.PublishEventIfSupported(vol, "StageInSucceeded", fmt.Sprintf("volumeID=%s image=%s", vol.VolumeID, vol.Spec.StageInSpec.Image))
+		stager.reportStageIn(vol, nil)
+		return stager.StageIn(ctx, vol)
 	case PhasePublished:
 		return nil
 	default:
@@ -83,80 +201,126 @@ func (stager *Stager) StageIn(vol *Volume) error {
 	}
 }
 
-func (stager *Stager) RollBackStageIn(vol *Volume) error {
+// failStageIn reports the stage-in failure through the same events and reports as failed pulls.
+func (stager *Stager) failStageIn(vol *Volume, err error) {
+	stager.PublishEventIfSupported(vol, "StageInFailed", fmt.Sprintf("volumeID=%s image=%s error=%s", vol.VolumeID, vol.Spec.StageInSpec.Image, err.Error()))
+	stager.reportStageIn(vol, err)
+}
+
+func (stager *Stager) RollBackStageIn(ctx context.Context, vol *Volume) error {
 	switch vol.Phase {
 	case PhaseInitState:
 		return nil
 	case PhaseContainerCreated:
-		if err := stager.Buildah.Delete(vol.VolumeID); err != nil {
+		if err := stager.Buildah.Delete(ctx, vol.VolumeID); err != nil {
 			return errors.Wrapf(err, "can't delete Buildah container(name=%s)", vol.VolumeID)
 		}
-		vol.Phase = PhaseInitState
-		return stager.RollBackStageIn(vol)
+		if err := stager.setPhase(vol, PhaseInitState); err != nil {
+			return err
+		}
+		return stager.RollBackStageIn(ctx, vol)
 	case PhaseContainerMounted:
-		if err := stager.Buildah.Umount(vol.VolumeID); err != nil {
+		if err := stager.Buildah.Umount(ctx, vol.VolumeID); err != nil {
 			return errors.Wrapf(err, "can't umount Buildah container(name=%s)", vol.VolumeID)
 		}
-		vol.Phase = PhaseContainerCreated
-		return stager.RollBackStageIn(vol)
+		if err := stager.setPhase(vol, PhaseContainerCreated); err != nil {
+			return err
+		}
+		return stager.RollBackStageIn(ctx, vol)
 	case PhaseTargetPathMounted:
-		if err := util.UnmountTargetPath(vol.TargetPath); err != nil {
+		if err := util.UnmountTargetPath(stager.mounter(), vol.TargetPath); err != nil {
 			return errors.Wrapf(err, "can't unmount volume(volumeID=%s) targetPath(=%s)", vol.VolumeID, vol.TargetPath)
 		}
-		vol.Phase = PhaseContainerMounted
-		return stager.RollBackStageIn(vol)
+		if err := stager.setPhase(vol, PhaseContainerMounted); err != nil {
+			return err
+		}
+		return stager.RollBackStageIn(ctx, vol)
 	default:
 		return errors.Errorf("internal error in rolling back publishing volume. volumeID=%s, phase=%s", vol.VolumeID, vol.Phase)
 	}
 }
 
-func (stager *Stager) StageOut(vol *Volume) error {
+// UnmountTargetPath performs only the first step of StageOut, which unmounts the published volume's targetPath.
+// StageOut can perform the rest later.
+func (stager *Stager) UnmountTargetPath(vol *Volume) error {
+	if vol.Phase != PhasePublished {
+		return nil
+	}
+	if err := util.UnmountTargetPath(stager.mounter(), vol.TargetPath); err != nil {
+		return errors.Wrapf(err, "can't unmount volume(volumeID=%s) targetPath(=%s)", vol.VolumeID, vol.TargetPath)
+	}
+	return stager.setPhase(vol, PhaseTargetPathUnMounted)
+}
+
+// StageOut unpublishes the volume. Buildah commands are killed when ctx is done.
+func (stager *Stager) StageOut(ctx context.Context, vol *Volume) error {
 	switch vol.Phase {
 	case PhasePublished:
-		if err := util.UnmountTargetPath(vol.TargetPath); err != nil {
-			return errors.Wrapf(err, "can't unmount volume(volumeID=%s) targetPath(=%s)", vol.VolumeID, vol.TargetPath)
+		if err := stager.UnmountTargetPath(vol); err != nil {
+			return err
 		}
-		vol.Phase = PhaseTargetPathUnMounted
-		return stager.StageOut(vol)
+		return stager.StageOut(ctx, vol)
 
 	case PhaseTargetPathUnMounted:
-		if !vol.Spec.StageOutSpec.Enabled {
-			vol.Phase = PhaseContainerImagePushed
-			return stager.StageOut(vol)
+		skipped := !vol.Spec.StageOutSpec.Enabled || vol.StagedOut
+		if !skipped {
+			var err error
+			if skipped, err = stager.prepareImageToPush(ctx, vol); err != nil {
+				return err
+			}
 		}
-		generatedTag, err := vol.TagGenerator.Generate(vol)
-		if err != nil {
-			return errors.Wrapf(err, "failed to generate image tag to stage out")
+		if skipped {
+			if err := stager.setPhase(vol, PhaseContainerImagePushed); err != nil {
+				return err
+			}
+			return stager.StageOut(ctx, vol)
 		}
-		vol.ImageToPush = fmt.Sprintf("%s:%s", vol.Spec.StageOutSpec.ImageRepository, generatedTag)
-		if err := stager.Buildah.Commit(vol.VolumeID, vol.ImageToPush, vol.Spec.StageOutSpec.Squash); err != nil {
-			return errors.Wrapf(err, "can't commit Buildah container(name=%s)", vol.VolumeID)
+		stager.startStage(vol)
+		stager.PublishEventIfSupported(vol, "StageOutStarted", fmt.Sprintf("volumeID=%s image=%s", vol.VolumeID, vol.ImageToPush))
+		// StageOutPublished may have committed the image and failed to push it.
+		if !vol.Committed {
+			if err := stager.commit(ctx, vol); err != nil {
+				return err
+			}
 		}
-		vol.Phase = PhaseContainerCommitted
-		return stager.StageOut(vol)
+		if err := stager.setPhase(vol, PhaseContainerCommitted); err != nil {
+			return err
+		}
+		return stager.StageOut(ctx, vol)
 	case PhaseContainerCommitted:
-		if err := stager.Buildah.Umount(vol.VolumeID); err != nil {
+		if err := stager.Buildah.Umount(ctx, vol.VolumeID); err != nil {
 			return errors.Wrapf(err, "can't umount Buildah container(name=%s)", vol.VolumeID)
 		}
-		vol.Phase = PhaseContainerUnMounted
-		return stager.StageOut(vol)
+		if err := stager.setPhase(vol, PhaseContainerUnMounted); err != nil {
+			return err
+		}
+		return stager.StageOut(ctx, vol)
 	case PhaseContainerUnMounted:
-		if err := stager.Buildah.Push(vol.VolumeID, vol.ImageToPush, vol.DockerConfigJson, vol.Spec.StageOutSpec.TlsVerify); err != nil {
-			stager.publishEventIfSupported(vol, "StageOutFailed", fmt.Sprintf("volumeID=%s image=%s error=%s", vol.VolumeID, vol.ImageToPush, err.Error()))
-			return errors.Wrapf(err, "can't push image(=%s)", vol.ImageToPush)
+		if err := stager.push(ctx, vol); err != nil {
+			if !stager.isSpoolEnabled(ctx, vol) {
+				return err
+			}
+			if errSpool := stager.spool(ctx, vol); errSpool != nil {
+				return errors.Wrapf(err, "can't spool the image either (%s)", errSpool.Error())
+			}
+		}
+		if err := stager.setPhase(vol, PhaseContainerImagePushed); err != nil {
+			return err
 		}
-		stager.publishEventIfSupported(vol, "StageOutSucceeded", fmt.Sprintf("volumeID=%s image=%s", vol.VolumeID, vol.ImageToPush))
-		vol.Phase = PhaseContainerImagePushed
-		return stager.StageOut(vol)
+		return stager.StageOut(ctx, vol)
 	case PhaseContainerImagePushed:
-		if err := stager.Buildah.Delete(vol.VolumeID); err != nil {
+		if err := stager.Buildah.Delete(ctx, vol.VolumeID); err != nil {
 			return errors.Wrapf(err, "can't delete Buildah container(name=%s)", vol.VolumeID)
 		}
-		vol.Phase = PhaseContainerDeleted
-		return stager.StageOut(vol)
+		if err := stager.setPhase(vol, PhaseContainerDeleted); err != nil {
+			return err
+		}
+		return stager.StageOut(ctx, vol)
 	case PhaseContainerDeleted:
-		vol.Phase = PhaseUnPublished
-		return stager.StageOut(vol)
+		if err := stager.setPhase(vol, PhaseUnPublished); err != nil {
+			return err
+		}
+		return stager.StageOut(ctx, vol)
 	case PhaseUnPublished:
 		return nil
 	default:
@@ -164,12 +328,216 @@ func (stager *Stager) StageOut(vol *Volume) error {
 	}
 }
 
+// StageOutPublished commits and pushes the published volume without unpublishing it.
+// StageOut then only cleans the volume up. The image is committed once and only pushed on retries.
+// It's spooled on push failures with stage-out/failurePolicy=Spool like StageOut.
+func (stager *Stager) StageOutPublished(ctx context.Context, vol *Volume) error {
+	if vol.Phase != PhasePublished {
+		return errors.Errorf("volume(volumeID=%s) can't be staged out in phase=%s", vol.VolumeID, vol.Phase)
+	}
+	if !vol.Spec.StageOutSpec.Enabled || vol.StagedOut {
+		return nil
+	}
+	skipped, err := stager.prepareImageToPush(ctx, vol)
+	if err != nil {
+		return err
+	}
+	if skipped {
+		vol.StagedOut = true
+		return stager.saveVolume(vol)
+	}
+	stager.startStage(vol)
+	stager.PublishEventIfSupported(vol, "StageOutStarted", fmt.Sprintf("volumeID=%s image=%s", vol.VolumeID, vol.ImageToPush))
+	if !vol.Committed {
+		if err := stager.commit(ctx, vol); err != nil {
+			return err
+		}
+		vol.Committed = true
+		if err := stager.saveVolume(vol); err != nil {
+			return err
+		}
+	}
+	if err := stager.push(ctx, vol); err != nil {
+		if !stager.isSpoolEnabled(ctx, vol) {
+			return err
+		}
+		if errSpool := stager.spool(ctx, vol); errSpool != nil {
+			return errors.Wrapf(err, "can't spool the image either (%s)", errSpool.Error())
+		}
+	}
+	vol.StagedOut = true
+	return stager.saveVolume(vol)
+}
+
+// Checkpoint commits the live container of the published volume and pushes it as a checkpoint image
+// (tagged with "-checkpoint-<N>") without unmounting targetPath. The local checkpoint image is removed after pushing.
+func (stager *Stager) Checkpoint(ctx context.Context, vol *Volume) error {
+	if vol.Phase != PhasePublished {
+		return errors.Errorf("volume(volumeID=%s) can't be checkpointed in phase=%s", vol.VolumeID, vol.Phase)
+	}
+	generatedTag, err := vol.TagGenerator.Generate(vol)
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate image tag to checkpoint")
+	}
+	checkpointImage := fmt.Sprintf("%s:%s-checkpoint-%d", vol.Spec.StageOutSpec.ImageRepository, generatedTag, vol.Checkpoints+1)
+
+	startedAt := vol.Clock.Now()
+	digest, err := stager.checkpoint(ctx, vol, checkpointImage)
+	// the next checkpoint is taken after the interval even if this one failed.
+	vol.LastCheckpointTime = vol.Clock.Now()
+	stager.auditCheckpoint(vol, checkpointImage, digest, vol.LastCheckpointTime.Sub(startedAt), err)
+	if err != nil {
+		stager.PublishEventIfSupported(vol, "CheckpointFailed", fmt.Sprintf("volumeID=%s image=%s error=%s", vol.VolumeID, checkpointImage, err.Error()))
+		if errSave := stager.saveVolume(vol); errSave != nil {
+			zlog.Error().Err(errSave).Str("VolumeID", vol.VolumeID).Msg("failed to save volume")
+		}
+		return err
+	}
+	vol.Checkpoints++
+	stager.PublishEventIfSupported(vol, "CheckpointSucceeded", fmt.Sprintf("volumeID=%s image=%s digest=%s", vol.VolumeID, checkpointImage, digest))
+	return stager.saveVolume(vol)
+}
+
+func (stager *Stager) auditCheckpoint(vol *Volume, checkpointImage, digest string, duration time.Duration, err error) {
+	entry := AuditEntry{
+		Time:      vol.LastCheckpointTime,
+		Operation: AuditOperationCheckpoint,
+		Pod: AuditPod{
+			Namespace: vol.podMeta.Namespace,
+			Name:      vol.podMeta.Name,
+			UID:       vol.podMeta.UID,
+		},
+		ServiceAccount:  vol.PodInfo.ServiceAccountName,
+		VolumeID:        vol.VolumeID,
+		VolumeName:      vol.VolumeName(),
+		Image:           checkpointImage,
+		Digest:          digest,
+		Outcome:         "Succeeded",
+		DurationSeconds: duration.Seconds(),
+	}
+	if err != nil {
+		entry.Outcome = "Failed"
+		entry.Error = err.Error()
+	}
+	stager.audit(entry)
+}
+
+func (stager *Stager) checkpoint(ctx context.Context, vol *Volume, checkpointImage string) (string, error) {
+	stageOutCtx := buildah.WithTimeout(ctx, vol.Spec.StageOutSpec.Timeout)
+	options, err := stager.commitOptions(vol)
+	if err != nil {
+		return "", err
+	}
+	if err := stager.Buildah.Commit(stageOutCtx, vol.VolumeID, checkpointImage, options); err != nil {
+		return "", errors.Wrapf(err, "can't commit Buildah container(name=%s)", vol.VolumeID)
+	}
+	defer func() {
+		if err := stager.Buildah.RemoveImage(ctx, checkpointImage); err != nil {
+			zlog.Warn().Err(err).Str("VolumeID", vol.VolumeID).Str("Image", checkpointImage).Msg("failed to remove checkpoint image")
+		}
+	}()
+
+	release, err := stager.acquire(ctx, stager.StageOutLimiter, vol, "CheckpointWaiting", checkpointImage)
+	if err != nil {
+		return "", errors.Wrapf(err, "gave up waiting to push image(=%s)", checkpointImage)
+	}
+	defer release()
+	digest, err := stager.Buildah.Push(stageOutCtx, vol.VolumeID, checkpointImage, vol.DockerConfigJson, vol.Spec.StageOutSpec.TlsVerify, retryPolicy(vol.Spec.StageOutSpec.Retry), pushOptions(vol.Spec.StageOutSpec))
+	if err != nil {
+		return "", errors.Wrapf(err, "can't push image(=%s)", checkpointImage)
+	}
+	return digest, nil
+}
+
+func (stager *Stager) commit(ctx context.Context, vol *Volume) error {
+	options, err := stager.commitOptions(vol)
+	if err == nil {
+		if err = stager.Buildah.Commit(buildah.WithTimeout(ctx, vol.Spec.StageOutSpec.Timeout), vol.VolumeID, vol.ImageToPush, options); err != nil {
+			err = errors.Wrapf(err, "can't commit Buildah container(name=%s)", vol.VolumeID)
+		}
+	}
+	if err != nil {
+		stager.PublishEventIfSupported(vol, "StageOutFailed", fmt.Sprintf("volumeID=%s image=%s error=%s", vol.VolumeID, vol.ImageToPush, err.Error()))
+		stager.reportStageOut(vol, api.StageOutStatusFailed, err)
+		return err
+	}
+	return nil
+}
+
+// push pushes the committed image to all the destinations which aren't pushed yet.
+// It fails only when a required destination fails. Failures of optional ones are just reported.
+func (stager *Stager) push(ctx context.Context, vol *Volume) error {
+	destinations := vol.destinations()
+	tags := make([]string, 0, len(destinations)-1)
+	for _, d := range destinations[1:] {
+		tags = append(tags, d.Image)
+	}
+	if err := stager.Buildah.Tag(ctx, vol.ImageToPush, tags...); err != nil {
+		err = errors.Wrapf(err, "can't tag image(=%s)", vol.ImageToPush)
+		stager.PublishEventIfSupported(vol, "StageOutFailed", fmt.Sprintf("volumeID=%s image=%s error=%s", vol.VolumeID, vol.ImageToPush, err.Error()))
+		stager.reportStageOut(vol, api.StageOutStatusFailed, err)
+		return err
+	}
+
+	var pushErr error
+	for i := range destinations {
+		d := &destinations[i]
+		if d.Pushed {
+			continue
+		}
+		digest, err := stager.pushTo(ctx, vol, d.Image)
+		if err != nil {
+			d.Error = err.Error()
+			zlog.Warn().Err(err).Str("VolumeID", vol.VolumeID).Str("Image", d.Image).Bool("Required", d.Required).Msg("failed to push image")
+			if d.Required && pushErr == nil {
+				pushErr = err
+			}
+			continue
+		}
+		d.Pushed, d.Digest, d.Error = true, digest, ""
+		zlog.Info().Str("VolumeID", vol.VolumeID).Str("Image", d.Image).Str("Digest", digest).Msg("pushed image")
+	}
+	vol.PushedDigest = destinations[0].Digest
+
+	if pushErr != nil {
+		// keep pushed destinations so that they aren't pushed again.
+		if err := stager.saveVolume(vol); err != nil {
+			zlog.Error().Err(err).Str("VolumeID", vol.VolumeID).Msg("failed to save volume")
+		}
+		stager.PublishEventIfSupported(vol, "StageOutFailed", fmt.Sprintf("volumeID=%s image=%s error=%s%s", vol.VolumeID, vol.ImageToPush, pushErr.Error(), destinationsMessage(destinations)))
+		stager.reportStageOut(vol, api.StageOutStatusFailed, pushErr)
+		return pushErr
+	}
+	stager.reportStageOut(vol, api.StageOutStatusSucceeded, nil)
+	stager.PublishEventIfSupported(vol, "StageOutSucceeded", fmt.Sprintf("volumeID=%s image=%s digest=%s pushedImage=%s%s", vol.VolumeID, vol.ImageToPush, vol.PushedDigest, vol.PushedImage(), destinationsMessage(destinations)))
+	return nil
+}
+
+func (stager *Stager) pushTo(ctx context.Context, vol *Volume, image string) (string, error) {
+	release, err := stager.acquire(ctx, stager.StageOutLimiter, vol, "StageOutWaiting", image)
+	if err != nil {
+		return "", errors.Wrapf(err, "gave up waiting to push image(=%s)", image)
+	}
+	defer release()
+	digest, err := stager.Buildah.Push(buildah.WithTimeout(ctx, vol.Spec.StageOutSpec.Timeout), vol.VolumeID, image, vol.DockerConfigJson, vol.Spec.StageOutSpec.TlsVerify, retryPolicy(vol.Spec.StageOutSpec.Retry), pushOptions(vol.Spec.StageOutSpec))
+	if err != nil {
+		return "", errors.Wrapf(err, "can't push image(=%s)", image)
+	}
+	return digest, nil
+}
+
 func (stager *Stager) StartGarbageCollection(stop chan struct{}) {
 	if stager.GcPeriod == 0 {
 		zlog.Info().Msg("builadh garbage collector disabled")
 		return
 	}
 	zlog.Info().Msg("starting builadh garbage collector")
-	wait.Until(stager.Buildah.GarbageCollectOnce, stager.GcPeriod, stop)
+	// buildah gc is killed when stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	wait.Until(func() { stager.Buildah.GarbageCollectOnce(ctx) }, stager.GcPeriod, stop)
 	zlog.Info().Msg("stopped builadh garbage collector")
 }
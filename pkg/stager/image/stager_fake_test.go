@@ -0,0 +1,380 @@
+package image_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/buildah"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	"k8s.io/utils/mount"
+)
+
+// staticOutcome resolves every pod to the outcome.
+type staticOutcome image.PodOutcome
+
+func (o staticOutcome) PodOutcome(vol *image.Volume) (image.PodOutcome, error) {
+	return image.PodOutcome(o), nil
+}
+
+var _ = Describe("Stager with fake backend", func() {
+	var volumeID string
+	var workDir string
+	var targetPath string
+	var backend *fake.Backend
+	var mounter *mount.FakeMounter
+	var stager *image.Stager
+
+	newVolume := func(extraContext map[string]string) *image.Volume {
+		context := map[string]string{
+			util.PodInfoNamespaceKey:          "test-ns",
+			util.PodInfoNameKey:               "test-name",
+			util.PodInfoUIDKey:                volumeID,
+			util.PodInfoServiceAccountNameKey: "test-sa",
+		}
+		for k, v := range extraContext {
+			context[k] = v
+		}
+		vol, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+			VolumeId:      volumeID,
+			TargetPath:    targetPath,
+			VolumeContext: context,
+		}, fakeClock, "busybox:latest")
+		Expect(err).NotTo(HaveOccurred())
+		return vol
+	}
+
+	BeforeEach(func() {
+		var err error
+		volumeID = uuid.New().String()
+		workDir, err = ioutil.TempDir("", "stager-fake-test-")
+		Expect(err).NotTo(HaveOccurred())
+		targetPath = filepath.Join(workDir, "targetpath")
+		Expect(os.MkdirAll(targetPath, 0777)).NotTo(HaveOccurred())
+
+		backend = fake.NewBackend(filepath.Join(workDir, "containers"))
+		mounter = mount.NewFakeMounter(nil)
+		stager = &image.Stager{
+			Buildah: backend,
+			Mounter: mounter,
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	Context("StageIn", func() {
+		It("should create, mount the container and mount it to targetPath", func() {
+			vol := newVolume(nil)
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhasePublished))
+
+			c := backend.Container(volumeID)
+			Expect(c).NotTo(BeNil())
+			Expect(c.Image).Should(Equal("busybox:latest"))
+			Expect(c.MountPoint).Should(Equal(vol.ProvisionedRoot))
+
+			notMnt, err := mounter.IsLikelyNotMountPoint(targetPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(notMnt).Should(BeFalse())
+		})
+
+		It("should reuse the existing container", func() {
+			vol := newVolume(nil)
+			Expect(backend.From(context.Background(), volumeID, "alpine:latest", "", true, buildah.RetryPolicy{})).NotTo(HaveOccurred())
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhasePublished))
+			Expect(backend.Container(volumeID).Image).Should(Equal("alpine:latest"))
+		})
+
+		It("should be rolled back when failed", func() {
+			vol := newVolume(nil)
+			backend.SetError("Mount", errors.New("mount failure"))
+			Expect(stager.StageIn(context.Background(), vol)).To(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseContainerCreated))
+
+			Expect(stager.RollBackStageIn(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseInitState))
+			Expect(backend.Container(volumeID)).To(BeNil())
+		})
+	})
+
+	Context("StageOut", func() {
+		It("should commit and push the container", func() {
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey:    "registry:5000/test/test",
+				api.StageOutTagGeneratorKey: "podUid",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseUnPublished))
+			Expect(vol.ImageToPush).Should(Equal("registry:5000/test/test:" + volumeID))
+			Expect(backend.Pushed()).Should(Equal([]string{vol.ImageToPush}))
+			Expect(vol.PushedDigest).Should(Equal(fake.Digest(vol.ImageToPush)))
+			Expect(vol.PushedImage()).Should(Equal("registry:5000/test/test@" + vol.PushedDigest))
+			Expect(backend.Container(volumeID)).To(BeNil())
+
+			notMnt, err := mounter.IsLikelyNotMountPoint(targetPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(notMnt).Should(BeTrue())
+		})
+
+		It("should label the image with its provenance and stage-out/labels", func() {
+			stager.NodeID = "test-node"
+			stager.DriverVersion = "v0.0.1"
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey: "registry:5000/test/test",
+				api.StageOutLabelsKey:    "team=ml, run={{.podNamespace}}-{{.podName}}," + api.PodNameLabel + "=spoofed",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(backend.ImageLabels(vol.ImageToPush)).Should(Equal(map[string]string{
+				"team":                     "ml",
+				"run":                      "test-ns-test-name",
+				api.PodNamespaceLabel:      "test-ns",
+				api.PodNameLabel:           "test-name",
+				api.PodUIDLabel:            volumeID,
+				api.PodServiceAccountLabel: "test-sa",
+				api.NodeIDLabel:            "test-node",
+				api.DriverVersionLabel:     "v0.0.1",
+				api.StageInImageLabel:      "busybox:latest",
+				api.StageInDigestLabel:     fake.Digest("busybox:latest"),
+				api.CommittedAtLabel:       fakeNow.Format(time.RFC3339),
+			}))
+		})
+
+		It("should fail when stage-out/labels is malformed", func() {
+			_, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+				VolumeId:   volumeID,
+				TargetPath: targetPath,
+				VolumeContext: map[string]string{
+					api.StageOutImageRepoKey: "registry:5000/test/test",
+					api.StageOutLabelsKey:    "team",
+				},
+			}, fakeClock, "busybox:latest")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should override the image config with stage-out/config.*", func() {
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey:        "registry:5000/test/test",
+				api.StageOutConfigEntrypointKey: `["/bin/sh", "-c"]`,
+				api.StageOutConfigCmdKey:        "echo hello",
+				api.StageOutConfigEnvKey:        "FOO=foo,BAR=bar=baz",
+				api.StageOutConfigWorkingDirKey: "/data",
+				api.StageOutConfigAuthorKey:     "ml-team",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(backend.ImageConfig(vol.ImageToPush)).Should(Equal(buildah.ImageConfig{
+				Entrypoint: `["/bin/sh", "-c"]`,
+				Cmd:        "echo hello",
+				Env:        map[string]string{"FOO": "foo", "BAR": "bar=baz"},
+				WorkingDir: "/data",
+				Author:     "ml-team",
+			}))
+		})
+
+		It("should fail when stage-out/config.entrypoint is malformed JSON array", func() {
+			_, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+				VolumeId:   volumeID,
+				TargetPath: targetPath,
+				VolumeContext: map[string]string{
+					api.StageOutImageRepoKey:        "registry:5000/test/test",
+					api.StageOutConfigEntrypointKey: `["/bin/sh", `,
+				},
+			}, fakeClock, "busybox:latest")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should push the image with stage-out/format and stage-out/compression", func() {
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey:        "registry:5000/test/test",
+				api.StageOutFormatKey:           "oci",
+				api.StageOutCompressionKey:      "zstd",
+				api.StageOutCompressionLevelKey: "3",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(backend.PushOptions(vol.ImageToPush)).Should(Equal(buildah.PushOptions{
+				Format:           "oci",
+				Compression:      "zstd",
+				CompressionLevel: 3,
+			}))
+		})
+
+		It("should push the image to stage-out/additionalTags and mirror repositories", func() {
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey:                  "registry:5000/test/test",
+				api.StageOutTagGeneratorKey:               "podUid",
+				api.StageOutAdditionalTagsKey:             "fixed:latest, podName",
+				api.StageOutMirrorRepositoriesKey:         "dr:5000/test/test",
+				api.StageOutOptionalMirrorRepositoriesKey: "cache:5000/test/test",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			backend.SetRegistryError("cache:5000", errors.New("cache is down"))
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseUnPublished))
+			Expect(vol.ImageToPush).Should(Equal("registry:5000/test/test:" + volumeID))
+			Expect(vol.PushedDigest).Should(Equal(fake.Digest(vol.ImageToPush)))
+			Expect(backend.Pushed()).Should(Equal([]string{
+				"registry:5000/test/test:" + volumeID,
+				"registry:5000/test/test:latest",
+				"registry:5000/test/test:test-name",
+				"dr:5000/test/test:" + volumeID,
+				"dr:5000/test/test:latest",
+				"dr:5000/test/test:test-name",
+			}))
+			Expect(vol.Destinations).Should(HaveLen(9))
+			for _, d := range vol.Destinations {
+				if d.Required {
+					Expect(d.Pushed).Should(BeTrue(), d.Image)
+					Expect(d.Digest).Should(Equal(fake.Digest(d.Image)))
+				} else {
+					Expect(d.Pushed).Should(BeFalse(), d.Image)
+					Expect(d.Error).Should(ContainSubstring("cache is down"))
+				}
+			}
+		})
+
+		It("should fail and push only the rest when a required mirror repository fails", func() {
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey:          "registry:5000/test/test",
+				api.StageOutTagGeneratorKey:       "podUid",
+				api.StageOutMirrorRepositoriesKey: "dr:5000/test/test",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			backend.SetRegistryError("dr:5000", errors.New("dr is down"))
+			Expect(stager.StageOut(context.Background(), vol)).To(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseContainerUnMounted))
+			Expect(vol.Destinations[0].Pushed).Should(BeTrue())
+			Expect(vol.Destinations[1].Pushed).Should(BeFalse())
+			Expect(vol.Destinations[1].Error).Should(ContainSubstring("dr is down"))
+
+			backend.SetRegistryError("dr:5000", nil)
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseUnPublished))
+			Expect(backend.Pushed()).Should(Equal([]string{
+				"registry:5000/test/test:" + volumeID,
+				"dr:5000/test/test:" + volumeID,
+			}))
+			Expect(vol.Destinations[1].Error).Should(BeEmpty())
+		})
+
+		It("should push only to stage-out/repositoryOnFailure without mirrors", func() {
+			stager.OutcomeResolver = staticOutcome(image.PodOutcomeFailed)
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey:           "registry:5000/test/test",
+				api.StageOutRepositoryOnFailureKey: "registry:5000/test/failed",
+				api.StageOutTagGeneratorKey:        "podUid",
+				api.StageOutAdditionalTagsKey:      "fixed:latest",
+				api.StageOutMirrorRepositoriesKey:  "dr:5000/test/test",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(backend.Pushed()).Should(Equal([]string{
+				"registry:5000/test/failed:" + volumeID,
+				"registry:5000/test/failed:latest",
+			}))
+		})
+
+		It("should commit only the included files on scratch with stage-out/base=scratch", func() {
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey: "registry:5000/test/test",
+				api.StageOutBaseKey:      api.StageOutBaseScratch,
+				api.StageOutIncludeKey:   "/outputs/, *.log",
+				api.StageOutExcludeKey:   "outputs/tmp",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+			for _, path := range []string{"outputs/result.csv", "outputs/tmp/cache", "train.log", "inputs/data.csv"} {
+				Expect(os.MkdirAll(filepath.Dir(filepath.Join(vol.ProvisionedRoot, path)), 0755)).NotTo(HaveOccurred())
+				Expect(ioutil.WriteFile(filepath.Join(vol.ProvisionedRoot, path), []byte(path), 0644)).NotTo(HaveOccurred())
+			}
+
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(backend.Pushed()).Should(Equal([]string{vol.ImageToPush}))
+			Expect(backend.ImageFiles(vol.ImageToPush)).Should(Equal([]string{"outputs/result.csv", "train.log"}))
+		})
+
+		It("should reject invalid stage-out/base and path filters", func() {
+			for _, attrs := range []map[string]string{
+				{api.StageOutBaseKey: "busybox"},
+				{api.StageOutIncludeKey: "outputs"},
+				{api.StageOutBaseKey: api.StageOutBaseContainer, api.StageOutExcludeKey: "tmp"},
+				{api.StageOutBaseKey: api.StageOutBaseScratch, api.StageOutIncludeKey: "outputs/[a-"},
+			} {
+				attrs[api.StageOutImageRepoKey] = "registry:5000/test/test"
+				_, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+					VolumeId:      volumeID,
+					TargetPath:    targetPath,
+					VolumeContext: attrs,
+				}, fakeClock, "busybox:latest")
+				Expect(err).To(HaveOccurred(), "%v", attrs)
+			}
+		})
+
+		It("should reject invalid stage-out/format and stage-out/compression", func() {
+			for _, attrs := range []map[string]string{
+				{api.StageOutFormatKey: "v2s1"},
+				{api.StageOutCompressionKey: "lz4"},
+				{api.StageOutCompressionKey: "zstd"},
+				{api.StageOutCompressionLevelKey: "10"},
+				{api.StageOutCompressionKey: "zstd", api.StageOutFormatKey: "oci", api.StageOutCompressionLevelKey: "0"},
+				{api.StageOutCompressionKey: "uncompressed", api.StageOutCompressionLevelKey: "1"},
+			} {
+				attrs[api.StageOutImageRepoKey] = "registry:5000/test/test"
+				_, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+					VolumeId:      volumeID,
+					TargetPath:    targetPath,
+					VolumeContext: attrs,
+				}, fakeClock, "busybox:latest")
+				Expect(err).To(HaveOccurred(), "%v", attrs)
+			}
+		})
+
+		It("should only delete the container when stage-out is disabled", func() {
+			vol := newVolume(nil)
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseUnPublished))
+			Expect(backend.Images()).Should(BeEmpty())
+			Expect(backend.Pushed()).Should(BeEmpty())
+			Expect(backend.Container(volumeID)).To(BeNil())
+		})
+
+		It("should resume from the failed phase", func() {
+			vol := newVolume(map[string]string{
+				api.StageOutImageRepoKey: "registry:5000/test/test",
+			})
+			Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+
+			backend.SetError("Push", errors.New("push failure"))
+			Expect(stager.StageOut(context.Background(), vol)).To(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseContainerUnMounted))
+
+			backend.SetError("Push", nil)
+			Expect(stager.StageOut(context.Background(), vol)).NotTo(HaveOccurred())
+			Expect(vol.Phase).Should(Equal(image.PhaseUnPublished))
+			Expect(backend.Pushed()).Should(HaveLen(1))
+		})
+	})
+})
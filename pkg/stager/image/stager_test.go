@@ -1,6 +1,7 @@
 package image_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -55,7 +56,7 @@ var _ = Describe("Stager", func() {
 			}, fakeClock, "busybox:latest")
 			Expect(err).NotTo(HaveOccurred())
 
-			err = stager.StageIn(vol)
+			err = stager.StageIn(context.Background(), vol)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(vol.Phase).Should(Equal(image.PhasePublished))
 
@@ -81,11 +82,11 @@ var _ = Describe("Stager", func() {
 			}, fakeClock, "busybox:latest")
 			Expect(err).NotTo(HaveOccurred())
 
-			err = stager.StageIn(vol)
+			err = stager.StageIn(context.Background(), vol)
 			Expect(err).To(HaveOccurred())
 			Expect(vol.Phase).Should(Equal(image.PhaseContainerMounted))
 
-			err = stager.RollBackStageIn(vol)
+			err = stager.RollBackStageIn(context.Background(), vol)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(vol.Phase).Should(Equal(image.PhaseInitState))
 		})
@@ -109,7 +110,7 @@ var _ = Describe("Stager", func() {
 			}, fakeClock, "busybox:latest")
 			Expect(err).NotTo(HaveOccurred())
 			// Stage-In first
-			err = stager.StageIn(vol)
+			err = stager.StageIn(context.Background(), vol)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(vol.Phase).Should(Equal(image.PhasePublished))
 
@@ -122,7 +123,7 @@ var _ = Describe("Stager", func() {
 			)).NotTo(HaveOccurred())
 
 			// Stage-out
-			err = stager.StageOut(vol)
+			err = stager.StageOut(context.Background(), vol)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(vol.Phase).Should(Equal(image.PhaseUnPublished))
 			expectedImageToPush := fmt.Sprintf("%s:%s", stageOutRepo, volumeID)
@@ -0,0 +1,263 @@
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/pkg/errors"
+	zlog "github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/clock"
+)
+
+// VolumeStore keeps volumes by their volume IDs.
+// Get returns nil when the volume doesn't exist.
+type VolumeStore interface {
+	Get(volumeID string) (*Volume, error)
+	Save(vol *Volume) error
+	Delete(volumeID string) error
+	List() ([]*Volume, error)
+}
+
+var _ VolumeStore = &MemoryVolumeStore{}
+var _ VolumeStore = &FileVolumeStore{}
+
+// MemoryVolumeStore keeps volumes only in memory.
+type MemoryVolumeStore struct {
+	mutex   sync.RWMutex
+	volumes map[string]*Volume
+}
+
+func NewMemoryVolumeStore() *MemoryVolumeStore {
+	return &MemoryVolumeStore{
+		volumes: map[string]*Volume{},
+	}
+}
+
+func (s *MemoryVolumeStore) Get(volumeID string) (*Volume, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.volumes[volumeID], nil
+}
+
+func (s *MemoryVolumeStore) Save(vol *Volume) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.volumes[vol.VolumeID] = vol
+	return nil
+}
+
+func (s *MemoryVolumeStore) Delete(volumeID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.volumes, volumeID)
+	return nil
+}
+
+func (s *MemoryVolumeStore) List() ([]*Volume, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	volumes := make([]*Volume, 0, len(s.volumes))
+	for _, vol := range s.volumes {
+		volumes = append(volumes, vol)
+	}
+	return volumes, nil
+}
+
+// FileVolumeStore persists volumes to {Dir}/{volumeID}.json so that they survive driver restarts.
+// Secrets (DockerConfigJson) are never written to the files.
+type FileVolumeStore struct {
+	Dir string
+
+	// serializes file writes
+	fileMutex sync.Mutex
+	memory    *MemoryVolumeStore
+}
+
+// NewFileVolumeStore creates a store in dir and loads volumes persisted in it.
+func NewFileVolumeStore(dir string, clock clock.Clock) (*FileVolumeStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "can't create state directory(=%s)", dir)
+	}
+	s := &FileVolumeStore{
+		Dir:    dir,
+		memory: NewMemoryVolumeStore(),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't read volume state file(=%s)", file)
+		}
+		state := volumeState{}
+		if err := json.Unmarshal(bytes, &state); err != nil {
+			zlog.Error().Err(err).Str("file", file).Msg("skip loading broken volume state file")
+			continue
+		}
+		vol, err := newVolumeFromState(state, clock)
+		if err != nil {
+			zlog.Error().Err(err).Str("file", file).Msg("skip loading invalid volume state")
+			continue
+		}
+		_ = s.memory.Save(vol)
+	}
+	return s, nil
+}
+
+func (s *FileVolumeStore) path(volumeID string) (string, error) {
+	if volumeID == "" || strings.ContainsAny(volumeID, `/\`) || strings.HasPrefix(volumeID, ".") {
+		return "", errors.Errorf("volumeID=%s can't be used as a file name", volumeID)
+	}
+	return filepath.Join(s.Dir, volumeID+".json"), nil
+}
+
+func (s *FileVolumeStore) Get(volumeID string) (*Volume, error) {
+	return s.memory.Get(volumeID)
+}
+
+func (s *FileVolumeStore) Save(vol *Volume) error {
+	path, err := s.path(vol.VolumeID)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(vol.state())
+	if err != nil {
+		return errors.Wrapf(err, "can't marshal volume(volumeID=%s)", vol.VolumeID)
+	}
+
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+
+	// write to a temporary file and rename it so that the state file is never partially written.
+	tmp, err := ioutil.TempFile(s.Dir, ".tmp-"+vol.VolumeID+"-")
+	if err != nil {
+		return errors.Wrapf(err, "can't create volume state file for volumeID=%s", vol.VolumeID)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(bytes); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "can't write volume state file for volumeID=%s", vol.VolumeID)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "can't write volume state file for volumeID=%s", vol.VolumeID)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "can't write volume state file for volumeID=%s", vol.VolumeID)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "can't write volume state file(=%s)", path)
+	}
+
+	return s.memory.Save(vol)
+}
+
+func (s *FileVolumeStore) Delete(volumeID string) error {
+	path, err := s.path(volumeID)
+	if err != nil {
+		return err
+	}
+
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can't delete volume state file(=%s)", path)
+	}
+	return s.memory.Delete(volumeID)
+}
+
+func (s *FileVolumeStore) List() ([]*Volume, error) {
+	return s.memory.List()
+}
+
+// volumeState is the persisted form of Volume.
+type volumeState struct {
+	Spec                     api.StagerSpec    `json:"spec"`
+	ReadOnly                 bool              `json:"readOnly"`
+	VolumeID                 string            `json:"volumeID"`
+	TargetPath               string            `json:"targetPath"`
+	DockerConfigJsonRequired bool              `json:"dockerConfigJsonRequired"`
+	PodInfo                  util.PodInfo      `json:"podInfo"`
+	Phase                    Phase             `json:"phase"`
+	PhaseTransitions         []PhaseTransition `json:"phaseTransitions"`
+	ProvisionedRoot          string            `json:"provisionedRoot"`
+	ImageToPush              string            `json:"imageToPush"`
+	StageInDigest            string            `json:"stageInDigest"`
+	PushedDigest             string            `json:"pushedDigest"`
+	Destinations             []Destination     `json:"destinations,omitempty"`
+	PodOutcome               PodOutcome        `json:"podOutcome,omitempty"`
+	Committed                bool              `json:"committed,omitempty"`
+	StagedOut                bool              `json:"stagedOut"`
+	Checkpoints              int               `json:"checkpoints"`
+	LastCheckpointTime       time.Time         `json:"lastCheckpointTime"`
+}
+
+func (vol *Volume) state() volumeState {
+	return volumeState{
+		Spec:                     vol.Spec,
+		ReadOnly:                 vol.ReadOnly,
+		VolumeID:                 vol.VolumeID,
+		TargetPath:               vol.TargetPath,
+		DockerConfigJsonRequired: vol.DockerConfigJson != "" || vol.dockerConfigJsonMissing,
+		PodInfo:                  vol.PodInfo,
+		Phase:                    vol.Phase,
+		PhaseTransitions:         vol.PhaseTransitions,
+		ProvisionedRoot:          vol.ProvisionedRoot,
+		ImageToPush:              vol.ImageToPush,
+		StageInDigest:            vol.StageInDigest,
+		PushedDigest:             vol.PushedDigest,
+		Destinations:             vol.Destinations,
+		PodOutcome:               vol.PodOutcome,
+		Committed:                vol.Committed,
+		StagedOut:                vol.StagedOut,
+		Checkpoints:              vol.Checkpoints,
+		LastCheckpointTime:       vol.LastCheckpointTime,
+	}
+}
+
+func newVolumeFromState(state volumeState, clock clock.Clock) (*Volume, error) {
+	tagGenerator, additionalTagGenerators, err := newTagGenerators(state.Spec.StageOutSpec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't load stager spec")
+	}
+	return &Volume{
+		Clock:                   clock,
+		Spec:                    state.Spec,
+		TagGenerator:            tagGenerator,
+		AdditionalTagGenerators: additionalTagGenerators,
+		ReadOnly:                state.ReadOnly,
+		VolumeID:                state.VolumeID,
+		TargetPath:              state.TargetPath,
+		dockerConfigJsonMissing: state.DockerConfigJsonRequired,
+		PodInfo:                 state.PodInfo,
+		podMeta: metav1.ObjectMeta{
+			Namespace: state.PodInfo.Namespace,
+			Name:      state.PodInfo.Name,
+			UID:       state.PodInfo.UID,
+		},
+		Phase:              state.Phase,
+		PhaseTransitions:   state.PhaseTransitions,
+		ProvisionedRoot:    state.ProvisionedRoot,
+		ImageToPush:        state.ImageToPush,
+		StageInDigest:      state.StageInDigest,
+		PushedDigest:       state.PushedDigest,
+		Destinations:       state.Destinations,
+		PodOutcome:         state.PodOutcome,
+		Committed:          state.Committed,
+		StagedOut:          state.StagedOut,
+		Checkpoints:        state.Checkpoints,
+		LastCheckpointTime: state.LastCheckpointTime,
+	}, nil
+}
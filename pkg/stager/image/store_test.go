@@ -0,0 +1,125 @@
+package image_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/image/fake"
+	"github.com/everpeace/csi-driver-stager/pkg/stager/util"
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	clock "k8s.io/utils/clock/testing"
+	"k8s.io/utils/mount"
+)
+
+var _ = Describe("FileVolumeStore", func() {
+	var volumeID string
+	var workDir string
+	var stateDir string
+	var targetPath string
+	var testClock *clock.FakeClock
+
+	BeforeEach(func() {
+		var err error
+		testClock = clock.NewFakeClock(fakeNow)
+		volumeID = uuid.New().String()
+		workDir, err = ioutil.TempDir("", "store-test-")
+		Expect(err).NotTo(HaveOccurred())
+		stateDir = filepath.Join(workDir, "state")
+		targetPath = filepath.Join(workDir, "targetpath")
+		Expect(os.MkdirAll(targetPath, 0777)).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).NotTo(HaveOccurred())
+	})
+
+	newVolume := func() *image.Volume {
+		vol, err := image.NewVolume(&csi.NodePublishVolumeRequest{
+			VolumeId:   volumeID,
+			TargetPath: targetPath,
+			VolumeContext: map[string]string{
+				api.StageOutImageRepoKey:          "registry:5000/test/test",
+				util.PodInfoNamespaceKey:          "test-ns",
+				util.PodInfoNameKey:               "test-name",
+				util.PodInfoUIDKey:                volumeID,
+				util.PodInfoServiceAccountNameKey: "test-sa",
+			},
+			Secrets: map[string]string{
+				image.DockerConfigJsonKey: `{"auths":{"registry:5000":{"auth":"c2VjcmV0"}}}`,
+			},
+		}, testClock, "busybox:latest")
+		Expect(err).NotTo(HaveOccurred())
+		return vol
+	}
+
+	It("should restore saved volumes without secrets", func() {
+		store, err := image.NewFileVolumeStore(stateDir, testClock)
+		Expect(err).NotTo(HaveOccurred())
+		vol := newVolume()
+		vol.Phase = image.PhaseContainerCommitted
+		vol.ImageToPush = "registry:5000/test/test:123"
+		vol.PushedDigest = "sha256:0123"
+		Expect(store.Save(vol)).NotTo(HaveOccurred())
+
+		bytes, err := ioutil.ReadFile(filepath.Join(stateDir, volumeID+".json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bytes)).NotTo(ContainSubstring("c2VjcmV0"))
+
+		restoredStore, err := image.NewFileVolumeStore(stateDir, testClock)
+		Expect(err).NotTo(HaveOccurred())
+		restored, err := restoredStore.Get(volumeID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored).NotTo(BeNil())
+		Expect(restored.Spec).Should(Equal(vol.Spec))
+		Expect(restored.PodInfo).Should(Equal(vol.PodInfo))
+		Expect(restored.TargetPath).Should(Equal(targetPath))
+		Expect(restored.Phase).Should(Equal(image.PhaseContainerCommitted))
+		Expect(restored.ImageToPush).Should(Equal("registry:5000/test/test:123"))
+		Expect(restored.PushedDigest).Should(Equal("sha256:0123"))
+		Expect(restored.DockerConfigJson).Should(BeEmpty())
+		Expect(restored.IsDockerConfigJsonMissing()).Should(BeTrue())
+
+		Expect(restoredStore.Delete(volumeID)).NotTo(HaveOccurred())
+		Expect(filepath.Join(stateDir, volumeID+".json")).NotTo(BeAnExistingFile())
+		Expect(restoredStore.Get(volumeID)).To(BeNil())
+	})
+
+	It("should let stage-out resume with the same image tag after restart", func() {
+		store, err := image.NewFileVolumeStore(stateDir, testClock)
+		Expect(err).NotTo(HaveOccurred())
+		backend := fake.NewBackend(filepath.Join(workDir, "containers"))
+		stager := &image.Stager{
+			Buildah: backend,
+			Mounter: mount.NewFakeMounter(nil),
+			Store:   store,
+		}
+
+		vol := newVolume()
+		Expect(stager.StageIn(context.Background(), vol)).NotTo(HaveOccurred())
+		backend.SetError("Push", errors.New("crashed"))
+		Expect(stager.StageOut(context.Background(), vol)).To(HaveOccurred())
+		imageToPush := vol.ImageToPush
+
+		// the tag generator (timestamp) would generate another tag after restart
+		testClock.Step(time.Hour)
+		backend.SetError("Push", nil)
+		restoredStore, err := image.NewFileVolumeStore(stateDir, testClock)
+		Expect(err).NotTo(HaveOccurred())
+		restored, err := restoredStore.Get(volumeID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored.Phase).Should(Equal(image.PhaseContainerUnMounted))
+
+		stager.Store = restoredStore
+		Expect(stager.StageOut(context.Background(), restored)).NotTo(HaveOccurred())
+		Expect(backend.Pushed()).Should(Equal([]string{imageToPush}))
+	})
+})
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	gotemplate "text/template"
 
+	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
 	"github.com/pkg/errors"
 )
 
@@ -12,66 +13,93 @@ type tagGenerator interface {
 	Generate(*Volume) (string, error)
 }
 
-func newTagGenerator(name string) (tagGenerator, error) {
+func newTagGenerator(name, arg string) (tagGenerator, error) {
 	switch name {
 	case "fixed":
-		return &FuncTagGenerator{fixedTGFunc}, nil
+		return &FuncTagGenerator{fixedTGFunc, arg}, nil
 	case "volumeId", "volumdID":
-		return &FuncTagGenerator{volumeIdTGFunc}, nil
+		return &FuncTagGenerator{volumeIdTGFunc, arg}, nil
 	case "timestamp":
-		return &FuncTagGenerator{timestampTGFunc}, nil
+		return &FuncTagGenerator{timestampTGFunc, arg}, nil
 	case "podName":
-		return &FuncTagGenerator{podNameTGFunc}, nil
+		return &FuncTagGenerator{podNameTGFunc, arg}, nil
 	case "podNamespace":
-		return &FuncTagGenerator{podNamespaceTGFunc}, nil
+		return &FuncTagGenerator{podNamespaceTGFunc, arg}, nil
 	case "podUid", "podUID":
-		return &FuncTagGenerator{podUIDTGFunc}, nil
+		return &FuncTagGenerator{podUIDTGFunc, arg}, nil
 	case "podServiceAccount":
-		return &FuncTagGenerator{podServiceAccountTGFunc}, nil
+		return &FuncTagGenerator{podServiceAccountTGFunc, arg}, nil
 	case "template":
-		return &FuncTagGenerator{templateTGFunc}, nil
+		return &FuncTagGenerator{templateTGFunc, arg}, nil
 	default:
 		return nil, errors.Errorf("tag generator=%s doesn't support", name)
 	}
 }
 
 type FuncTagGenerator struct {
-	f func(*Volume) (string, error)
+	f   func(volume *Volume, arg string) (string, error)
+	arg string
 }
 
 func (f FuncTagGenerator) Generate(spec *Volume) (string, error) {
-	return f.f(spec)
+	return f.f(spec, f.arg)
 }
 
-func volumeIdTGFunc(volume *Volume) (string, error) {
+// newTagGenerators returns generators of stage-out/tagGenerator and stage-out/additionalTags.
+func newTagGenerators(spec api.StageOutSpec) (tagGenerator, []tagGenerator, error) {
+	primary, err := newTagGenerator(spec.TagGenerator, spec.TagGeneratorArg)
+	if err != nil {
+		return nil, nil, err
+	}
+	additionals := make([]tagGenerator, 0, len(spec.AdditionalTags))
+	for _, tg := range spec.AdditionalTags {
+		additional, err := newTagGenerator(tg.Name, tg.Arg)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid %s", api.StageOutAdditionalTagsKey)
+		}
+		additionals = append(additionals, additional)
+	}
+	return primary, additionals, nil
+}
+
+func volumeIdTGFunc(volume *Volume, arg string) (string, error) {
 	return volume.VolumeID, nil
 }
 
-func fixedTGFunc(volume *Volume) (string, error) {
-	return volume.Spec.StageOutSpec.TagGeneratorArg, nil
+func fixedTGFunc(volume *Volume, arg string) (string, error) {
+	return arg, nil
 }
 
-func timestampTGFunc(volume *Volume) (string, error) {
+func timestampTGFunc(volume *Volume, arg string) (string, error) {
 	return fmt.Sprintf("%d", volume.Clock.Now().UTC().Unix()), nil
 }
 
-func podNameTGFunc(volume *Volume) (string, error) {
+func podNameTGFunc(volume *Volume, arg string) (string, error) {
 	return volume.PodInfo.Name, nil
 }
 
-func podNamespaceTGFunc(volume *Volume) (string, error) {
+func podNamespaceTGFunc(volume *Volume, arg string) (string, error) {
 	return volume.PodInfo.Namespace, nil
 }
 
-func podUIDTGFunc(volume *Volume) (string, error) {
+func podUIDTGFunc(volume *Volume, arg string) (string, error) {
 	return string(volume.PodInfo.UID), nil
 }
 
-func podServiceAccountTGFunc(volume *Volume) (string, error) {
+func podServiceAccountTGFunc(volume *Volume, arg string) (string, error) {
 	return volume.PodInfo.ServiceAccountName, nil
 }
 
-func templateTGFunc(volume *Volume) (string, error) {
+func templateTGFunc(volume *Volume, arg string) (string, error) {
+	rendered, err := renderTemplate("templateTGFunc tag generator", arg, volume)
+	if err != nil {
+		return "", errors.Wrap(err, "failed generating image tag")
+	}
+	return rendered, nil
+}
+
+// renderTemplate renders text with the volume's values (e.g. "{{.podName}}").
+func renderTemplate(name, text string, volume *Volume) (string, error) {
 	context := map[string]string{
 		"timestamp":         fmt.Sprintf("%d", volume.Clock.Now().UTC().Unix()),
 		"volumeId":          volume.VolumeID,
@@ -83,14 +111,14 @@ func templateTGFunc(volume *Volume) (string, error) {
 		"podServiceAccount": volume.PodInfo.ServiceAccountName,
 	}
 
-	tmpl, err := gotemplate.New("templateTGFunc tag generator").Parse(volume.Spec.StageOutSpec.TagGeneratorArg)
+	tmpl, err := gotemplate.New(name).Parse(text)
 	if err != nil {
-		return "", errors.Wrap(err, "failed generating image tag")
+		return "", err
 	}
 
 	var rendered bytes.Buffer
 	if err := tmpl.Execute(&rendered, context); err != nil {
-		return "", errors.Wrap(err, "failed generating image tag")
+		return "", err
 	}
 
 	return rendered.String(), nil
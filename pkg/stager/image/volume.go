@@ -1,6 +1,10 @@
 package image
 
 import (
+	"fmt"
+	"reflect"
+	"time"
+
 	api "github.com/everpeace/csi-driver-stager/pkg/stager/api/image"
 	"k8s.io/utils/clock"
 
@@ -38,6 +42,8 @@ type Volume struct {
 	// User defined spec
 	Spec         api.StagerSpec
 	TagGenerator tagGenerator
+	// AdditionalTagGenerators generate stage-out/additionalTags.
+	AdditionalTagGenerators []tagGenerator
 
 	// values from PublishVolumeRequest
 	ReadOnly         bool
@@ -47,10 +53,35 @@ type Volume struct {
 	PodInfo          util.PodInfo
 	podMeta          metav1.ObjectMeta
 
+	// true when the volume was restored from VolumeStore without its DockerConfigJson
+	dockerConfigJsonMissing bool
+
 	// Status
-	Phase           Phase
-	ProvisionedRoot string
-	ImageToPush     string
+	Phase Phase
+	// PhaseTransitions is the history of Phase.
+	PhaseTransitions []PhaseTransition
+	ProvisionedRoot  string
+	ImageToPush      string
+	// StageInDigest is the manifest digest of the stage-in image.
+	StageInDigest string
+	// PushedDigest is the manifest digest of ImageToPush. It is empty until the image is pushed.
+	PushedDigest string
+	// Destinations are all the references to push the image to. The first one is ImageToPush.
+	Destinations []Destination
+	// Committed is true when StageOutPublished committed ImageToPush. Retries only push it.
+	Committed bool
+	// PodOutcome is the outcome of the pod once it's resolved. It's kept so that stage-out doesn't
+	// depend on the pod after it's gone.
+	PodOutcome PodOutcome
+	// Checkpoints is the number of pushed checkpoint images.
+	Checkpoints        int
+	LastCheckpointTime time.Time
+	// StagedOut is true when stage-out finished (i.e. the image was pushed or stage-out was skipped)
+	// before unpublishing the volume.
+	StagedOut bool
+
+	// stageStartedAt is when the running stage-in or stage-out started. It's kept only in memory.
+	stageStartedAt time.Time
 }
 
 func NewVolume(req *csi.NodePublishVolumeRequest, clock clock.Clock, defaultStageInImage string) (*Volume, error) {
@@ -60,7 +91,7 @@ func NewVolume(req *csi.NodePublishVolumeRequest, clock clock.Clock, defaultStag
 	if err != nil {
 		return nil, errors.Wrapf(err, "can't load stager spec")
 	}
-	tagGenerator, err := newTagGenerator(spec.StageOutSpec.TagGenerator)
+	tagGenerator, additionalTagGenerators, err := newTagGenerators(spec.StageOutSpec)
 	if err != nil {
 		return nil, errors.Wrapf(err, "can't load stager spec")
 	}
@@ -90,15 +121,16 @@ func NewVolume(req *csi.NodePublishVolumeRequest, clock clock.Clock, defaultStag
 	}
 
 	return &Volume{
-		Clock:            clock,
-		Spec:             *spec,
-		TagGenerator:     tagGenerator,
-		VolumeID:         volumeID,
-		TargetPath:       targetPath,
-		DockerConfigJson: dockerConfigJson,
-		ReadOnly:         req.GetReadonly(),
-		PodInfo:          podInfo,
-		Phase:            PhaseInitState,
+		Clock:                   clock,
+		Spec:                    *spec,
+		TagGenerator:            tagGenerator,
+		AdditionalTagGenerators: additionalTagGenerators,
+		VolumeID:                volumeID,
+		TargetPath:              targetPath,
+		DockerConfigJson:        dockerConfigJson,
+		ReadOnly:                req.GetReadonly(),
+		PodInfo:                 podInfo,
+		Phase:                   PhaseInitState,
 		podMeta: metav1.ObjectMeta{
 			Namespace: podInfo.Namespace,
 			Name:      podInfo.Name,
@@ -106,3 +138,55 @@ func NewVolume(req *csi.NodePublishVolumeRequest, clock clock.Clock, defaultStag
 		},
 	}, nil
 }
+
+// IsDockerConfigJsonMissing returns true when the volume was published with DockerConfigJson
+// but it was lost because the volume was restored from VolumeStore.
+func (vol *Volume) IsDockerConfigJsonMissing() bool {
+	return vol.dockerConfigJsonMissing
+}
+
+func (vol *Volume) SetDockerConfigJson(dockerConfigJson string) {
+	vol.DockerConfigJson = dockerConfigJson
+	vol.dockerConfigJsonMissing = false
+}
+
+// IsPublishing returns true when the volume is being published or has been published.
+func (vol *Volume) IsPublishing() bool {
+	switch vol.Phase {
+	case PhaseInitState, PhaseContainerCreated, PhaseContainerMounted, PhaseTargetPathMounted, PhasePublished:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsSamePublication returns true when other is published with the same parameters as vol.
+func (vol *Volume) IsSamePublication(other *Volume) bool {
+	return vol.VolumeID == other.VolumeID &&
+		vol.TargetPath == other.TargetPath &&
+		vol.ReadOnly == other.ReadOnly &&
+		vol.PodInfo == other.PodInfo &&
+		reflect.DeepEqual(vol.Spec, other.Spec)
+}
+
+// PushedImage returns the immutable reference (e.g. "repo@sha256:...") of the pushed image.
+// It returns empty string until the image is pushed.
+func (vol *Volume) PushedImage() string {
+	return pushedImage(vol.ImageToPush, vol.PushedDigest)
+}
+
+func pushedImage(image, digest string) string {
+	if image == "" || digest == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s@%s", util.RepositoryOf(image), digest)
+}
+
+// VolumeName returns the name of the volume in the pod. It falls back to VolumeID
+// when TargetPath doesn't follow kubelet's layout.
+func (vol *Volume) VolumeName() string {
+	if _, volumeName, ok := util.ParseTargetPath(vol.TargetPath); ok {
+		return volumeName
+	}
+	return vol.VolumeID
+}
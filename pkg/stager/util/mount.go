@@ -6,8 +6,7 @@ import (
 	"k8s.io/utils/mount"
 )
 
-func MountTargetPath(source, target string, options []string) error {
-	mounter := mount.New("")
+func MountTargetPath(mounter mount.Interface, source, target string, options []string) error {
 	if err := mounter.Mount(source, target, "", options); err != nil {
 		zlog.Error().
 			Str("source", source).
@@ -22,8 +21,8 @@ func MountTargetPath(source, target string, options []string) error {
 	return nil
 }
 
-func UnmountTargetPath(target string) error {
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(target)
+func UnmountTargetPath(mounter mount.Interface, target string) error {
+	notMnt, err := mounter.IsLikelyNotMountPoint(target)
 	if err != nil {
 		zlog.Debug().
 			Str("target", target).
@@ -31,7 +30,7 @@ func UnmountTargetPath(target string) error {
 		return errors.Wrapf(err, "unmount %s failed", target)
 	}
 	if !notMnt {
-		err := mount.New("").Unmount(target)
+		err := mounter.Unmount(target)
 		if err != nil {
 			zlog.Debug().
 				Str("target", target).
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"strings"
+)
+
+const DefaultRegistry = "docker.io"
+
+// RepositoryOf strips the tag and the digest from the image reference
+// (e.g. "registry:5000/foo/bar" for "registry:5000/foo/bar:tag").
+func RepositoryOf(image string) string {
+	if i := strings.IndexRune(image, '@'); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// RegistryOf returns the registry host of the image reference (e.g. "registry:5000" for "registry:5000/foo/bar:tag").
+// It returns DefaultRegistry for references without registry host (e.g. "busybox:latest").
+func RegistryOf(image string) string {
+	i := strings.IndexRune(image, '/')
+	if i < 0 {
+		return DefaultRegistry
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return DefaultRegistry
+	}
+	return host
+}
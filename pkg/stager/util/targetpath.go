@@ -0,0 +1,20 @@
+package util
+
+import (
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// kubelet publishes csi volumes to /var/lib/kubelet/pods/{podUID}/volumes/kubernetes.io~csi/{volumeName}/mount
+var targetPathPattern = regexp.MustCompile(`/pods/([^/]+)/volumes/kubernetes\.io~csi/([^/]+)/mount/?$`)
+
+// ParseTargetPath extracts pod's uid and volume name from kubelet's targetPath.
+// ok is false when targetPath doesn't follow kubelet's layout.
+func ParseTargetPath(targetPath string) (podUID types.UID, volumeName string, ok bool) {
+	matches := targetPathPattern.FindStringSubmatch(targetPath)
+	if matches == nil {
+		return "", "", false
+	}
+	return types.UID(matches[1]), matches[2], true
+}